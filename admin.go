@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// NewAdminServer exposes /metrics for Prometheus and the health probes,
+// without accepting any metrics itself.
+func NewAdminServer(cfg AdminConfig, health *Health) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	if health != nil {
+		health.Register(mux)
+	}
+
+	// Only GETs are served, so the whole request has to arrive as fast as
+	// its headers.
+	return &http.Server{
+		Addr:              net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		Handler:           mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readHeaderTimeout,
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	defaultMaxBodySize = 10 << 20
+
+	// The headers of a request must arrive within readHeaderTimeout and the
+	// whole request within the read timeout, so slow clients cannot hold
+	// connections open.
+	readHeaderTimeout  = 10 * time.Second
+	defaultReadTimeout = time.Minute
+
+	correlationHeader = "X-Correlation-ID"
+	requestIDHeader   = "X-Request-ID"
+)
+
+func NewApiServer(cfg ApiConfig, sink Sink, validator *Validator, health *Health) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("POST /v1/metrics", IngestHandler(cfg, sink, validator))
+	mux.Handle("GET /metrics", promhttp.Handler())
+	if health != nil {
+		health.Register(mux)
+	}
+
+	readTimeout := cfg.ReadTimeout
+	if readTimeout <= 0 {
+		readTimeout = defaultReadTimeout
+	}
+
+	return &http.Server{
+		Addr:              net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		Handler:           mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+	}
+}
+
+// IngestHandler accepts any body the RabbitMQ consumer does, decompressed by
+// its Content-Encoding and decoded by its Content-Type, and writes it through
+// SendMetric. The request's X-Correlation-ID, else its X-Request-ID, else a
+// generated id is echoed back and carried by its log lines.
+func IngestHandler(cfg ApiConfig, sink Sink, validator *Validator) http.Handler {
+	maxBodySize := cfg.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = defaultMaxBodySize
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		messagesReceived.WithLabelValues(SourceApi).Inc()
+
+		correlationID := r.Header.Get(correlationHeader)
+		if correlationID == "" {
+			correlationID = r.Header.Get(requestIDHeader)
+		}
+		correlationID = (&Message{CorrelationID: correlationID}).LogID()
+		w.Header().Set(correlationHeader, correlationID)
+		logger := Log.With(correlationKey, correlationID)
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			messagesFailed.WithLabelValues(SourceApi, StageParse).Inc()
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				writeError(w, http.StatusRequestEntityTooLarge, err)
+				return
+			}
+
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		body, err = Decompress(body, r.Header.Get("Content-Encoding"), cfg.MaxDecompressedSize)
+		if err != nil {
+			logger.Error("Cannot decompress api request", "err", err)
+			messagesFailed.WithLabelValues(SourceApi, StageParse).Inc()
+			switch {
+			case errors.Is(err, ErrUnsupportedEncoding):
+				writeError(w, http.StatusUnsupportedMediaType, err)
+			case errors.Is(err, ErrDecompressedTooLarge):
+				writeError(w, http.StatusRequestEntityTooLarge, err)
+			default:
+				writeError(w, http.StatusBadRequest, err)
+			}
+			return
+		}
+
+		metrics, err := DecodeMessage(body, r.Header.Get("Content-Type"), cfg.Format, cfg.Time)
+		if err != nil {
+			logger.Error("Cannot consume api request", "err", err)
+			messagesFailed.WithLabelValues(SourceApi, StageParse).Inc()
+			if errors.Is(err, ErrUnsupportedContentType) {
+				writeError(w, http.StatusUnsupportedMediaType, err)
+				return
+			}
+
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		messagesParsed.WithLabelValues(SourceApi).Inc()
+
+		if err := validator.Validate(metrics); err != nil {
+			logger.Error("Rejected invalid api request", "err", err)
+			messagesFailed.WithLabelValues(SourceApi, StageValidate).Inc()
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		if err := SendMetric(sink, metrics); err != nil {
+			logger.Error("Cannot write metrics", "err", err)
+			messagesFailed.WithLabelValues(SourceApi, StageWrite).Inc()
+			if errors.Is(err, ErrCircuitOpen) {
+				writeError(w, http.StatusServiceUnavailable, err)
+				return
+			}
+
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+type errorResponse struct {
+	Error   string            `json:"error"`
+	Details []ValidationIssue `json:"details,omitempty"`
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	response := errorResponse{Error: err.Error()}
+
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		response.Details = validationErr.Issues
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
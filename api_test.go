@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+type fakeWriteAPI struct {
+	mu      sync.Mutex
+	points  []*write.Point
+	records []string
+	err     error
+	flushed int
+}
+
+func (f *fakeWriteAPI) WriteRecord(ctx context.Context, line ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+
+	f.records = append(f.records, line...)
+	return nil
+}
+
+func (f *fakeWriteAPI) WritePoint(ctx context.Context, point ...*write.Point) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+
+	f.points = append(f.points, point...)
+	return nil
+}
+
+func (f *fakeWriteAPI) EnableBatching() {}
+
+func (f *fakeWriteAPI) Flush(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.flushed++
+	return nil
+}
+
+func (f *fakeWriteAPI) Records() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.records...)
+}
+
+func (f *fakeWriteAPI) SetErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.err = err
+}
+
+func (f *fakeWriteAPI) Points() []*write.Point {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]*write.Point(nil), f.points...)
+}
+
+func TestIngestHandler(t *testing.T) {
+	validBody := `{
+		"host": "server1",
+		"metrics": [
+			{"name": "cpu_usage", "value": 75.5, "time": "2023-10-15T14:30:45Z"},
+			{"name": "mem_usage", "value": 60.2, "time": "2023-10-15T14:30:45Z"}
+		]
+	}`
+
+	tests := []struct {
+		name           string
+		method         string
+		body           string
+		writeErr       error
+		maxBodySize    int64
+		expectedStatus int
+		expectedPoints int
+	}{
+		{
+			name:           "valid envelope",
+			method:         http.MethodPost,
+			body:           validBody,
+			expectedStatus: http.StatusNoContent,
+			expectedPoints: 2,
+		},
+		{
+			name:           "invalid json",
+			method:         http.MethodPost,
+			body:           `{invalid json`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "influx write failure",
+			method:         http.MethodPost,
+			body:           validBody,
+			writeErr:       errors.New("influx down"),
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name:           "body too large",
+			method:         http.MethodPost,
+			body:           validBody,
+			maxBodySize:    10,
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:           "wrong method",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeAPI := &fakeWriteAPI{err: tt.writeErr}
+			server := NewApiServer(ApiConfig{MaxBodySize: tt.maxBodySize}, NewInfluxSink(writeAPI), nil, nil)
+
+			req := httptest.NewRequest(tt.method, "/v1/metrics", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			server.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d (%s)", tt.expectedStatus, rec.Code, rec.Body.String())
+			}
+			if len(writeAPI.Points()) != tt.expectedPoints {
+				t.Errorf("expected %d points written, got %d", tt.expectedPoints, len(writeAPI.Points()))
+			}
+		})
+	}
+}
+
+func TestIngestHandler_ValidationDetails(t *testing.T) {
+	validator, err := NewValidator(ValidationConfig{Strict: true})
+	if err != nil {
+		t.Fatalf("NewValidator() unexpected error: %v", err)
+	}
+
+	writeAPI := &fakeWriteAPI{}
+	server := NewApiServer(ApiConfig{}, NewInfluxSink(writeAPI), validator, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/metrics", strings.NewReader(`{"metrics": []}`))
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status %d, got %d", http.StatusUnprocessableEntity, rec.Code)
+	}
+
+	var response errorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(response.Details) != 1 || response.Details[0].Path != "metrics" {
+		t.Errorf("expected validation details for metrics, got %+v", response.Details)
+	}
+	if len(writeAPI.Points()) != 0 {
+		t.Errorf("expected nothing written, got %d points", len(writeAPI.Points()))
+	}
+}
+
+func TestNewApiServer_Addr(t *testing.T) {
+	server := NewApiServer(ApiConfig{Host: "0.0.0.0", Port: 8080}, NewInfluxSink(&fakeWriteAPI{}), nil, nil)
+	if server.Addr != "0.0.0.0:8080" {
+		t.Errorf("expected addr 0.0.0.0:8080, got %s", server.Addr)
+	}
+}
+
+func TestNewApiServer_Timeouts(t *testing.T) {
+	server := NewApiServer(ApiConfig{}, NewInfluxSink(&fakeWriteAPI{}), nil, nil)
+	if server.ReadHeaderTimeout != readHeaderTimeout || server.ReadTimeout != defaultReadTimeout {
+		t.Errorf("expected default read timeouts, got %v and %v", server.ReadHeaderTimeout, server.ReadTimeout)
+	}
+
+	server = NewApiServer(ApiConfig{ReadTimeout: 5 * time.Second}, NewInfluxSink(&fakeWriteAPI{}), nil, nil)
+	if server.ReadTimeout != 5*time.Second {
+		t.Errorf("expected configured read timeout, got %v", server.ReadTimeout)
+	}
+
+	admin := NewAdminServer(AdminConfig{}, nil)
+	if admin.ReadHeaderTimeout == 0 || admin.ReadTimeout == 0 {
+		t.Errorf("expected admin read timeouts, got %v and %v", admin.ReadHeaderTimeout, admin.ReadTimeout)
+	}
+}
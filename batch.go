@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+const (
+	defaultBatchSize     = 1
+	defaultFlushInterval = time.Second
+	defaultMaxInFlight   = 1
+)
+
+type batch struct {
+	points []*write.Point
+	msgs   []*Message
+	err    error
+	done   chan struct{}
+}
+
+// BatchWriter accumulates points across messages and writes them to the sink
+// in one request once Size points are pending or FlushInterval has passed.
+// Written batches are handed to onSuccess in the order they were added,
+// failed batches to onFailure one message at a time.
+type BatchWriter struct {
+	sink      Sink
+	size      int
+	interval  time.Duration
+	onSuccess func(msgs []*Message)
+	onFailure func(msg *Message, err error)
+
+	mu      sync.Mutex
+	pending *batch
+	timer   *time.Timer
+	closed  bool
+
+	inFlight chan struct{}
+	ordered  chan *batch
+	settled  chan struct{}
+}
+
+// NewBatchWriter acks every message of a written batch on its own unless
+// onSuccess is given.
+func NewBatchWriter(sink Sink, cfg BatchConfig, onSuccess func(msgs []*Message), onFailure func(msg *Message, err error)) *BatchWriter {
+	size := cfg.Size
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+
+	interval := cfg.FlushInterval
+	if interval <= 0 {
+		interval = defaultFlushInterval
+	}
+
+	maxInFlight := cfg.MaxInFlight
+	if maxInFlight <= 0 {
+		maxInFlight = defaultMaxInFlight
+	}
+
+	if onSuccess == nil {
+		onSuccess = ackEach
+	}
+
+	w := &BatchWriter{
+		sink:      sink,
+		size:      size,
+		interval:  interval,
+		onSuccess: onSuccess,
+		onFailure: onFailure,
+		inFlight:  make(chan struct{}, maxInFlight),
+		ordered:   make(chan *batch, maxInFlight),
+		settled:   make(chan struct{}),
+	}
+
+	go w.settle()
+
+	return w
+}
+
+// Add queues the points of metrics together with the message they came from.
+// It blocks while MaxInFlight batches are waiting on the sink.
+func (w *BatchWriter) Add(metrics []*Metric, msg *Message) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.pending == nil {
+		w.pending = &batch{}
+		w.timer = time.AfterFunc(w.interval, w.flushOnTimer)
+	}
+
+	w.pending.points = append(w.pending.points, NewPoints(metrics)...)
+	w.pending.msgs = append(w.pending.msgs, msg)
+
+	if len(w.pending.points) >= w.size {
+		w.flushLocked()
+	}
+}
+
+// Close writes whatever is pending and waits until every batch has been
+// settled or ctx is done.
+func (w *BatchWriter) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.flushLocked()
+		w.closed = true
+		close(w.ordered)
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.settled:
+		return nil
+	case <-ctx.Done():
+		return ErrShutdownTimeout
+	}
+}
+
+func (w *BatchWriter) flushOnTimer() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.closed {
+		w.flushLocked()
+	}
+}
+
+func (w *BatchWriter) flushLocked() {
+	if w.pending == nil {
+		return
+	}
+
+	b := w.pending
+	w.pending = nil
+	w.timer.Stop()
+
+	batchSize.Observe(float64(len(b.points)))
+	b.done = make(chan struct{})
+	w.inFlight <- struct{}{}
+	w.ordered <- b
+
+	go func() {
+		defer close(b.done)
+		b.err = w.sink.Write(context.Background(), b.points)
+	}()
+}
+
+// settle acks or fails batches strictly in the order they were flushed, which
+// keeps cumulative acks from covering messages of a batch still in flight.
+func (w *BatchWriter) settle() {
+	defer close(w.settled)
+
+	for b := range w.ordered {
+		<-b.done
+
+		if b.err != nil {
+			for _, msg := range b.msgs {
+				w.onFailure(msg, b.err)
+			}
+		} else {
+			Log.Info("Wrote metrics to sinks", "points", len(b.points), "messages", len(b.msgs))
+			w.onSuccess(b.msgs)
+		}
+
+		<-w.inFlight
+	}
+}
+
+func ackEach(msgs []*Message) {
+	for _, msg := range msgs {
+		if err := msg.Ack(); err != nil {
+			Log.Error("Cannot ack message", "err", err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// ackLog records which test messages were acked, in order.
+type ackLog struct {
+	mu  sync.Mutex
+	ids []int
+}
+
+func (a *ackLog) message(id int) *Message {
+	return &Message{
+		Ack: func() error {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+
+			a.ids = append(a.ids, id)
+			return nil
+		},
+	}
+}
+
+func (a *ackLog) Acked() []int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return append([]int(nil), a.ids...)
+}
+
+// gatedWriteAPI blocks each write until the test releases the gate named
+// after its first point, so batches can be completed out of order.
+type gatedWriteAPI struct {
+	fakeWriteAPI
+	gates map[string]chan error
+}
+
+func (g *gatedWriteAPI) WritePoint(ctx context.Context, point ...*write.Point) error {
+	if err := <-g.gates[point[0].Name()]; err != nil {
+		return err
+	}
+
+	return g.fakeWriteAPI.WritePoint(ctx, point...)
+}
+
+func testMetrics(n int) []*Metric {
+	metrics := make([]*Metric, n)
+	for i := range metrics {
+		metrics[i] = &Metric{Name: "cpu_usage", Value: float64(i), Timestamp: time.Unix(int64(i), 0)}
+	}
+	return metrics
+}
+
+func TestBatchWriter_FlushesOnSize(t *testing.T) {
+	writeAPI := &fakeWriteAPI{}
+	acks := &ackLog{}
+	var batches [][]*Message
+	var mu sync.Mutex
+	writer := NewBatchWriter(NewInfluxSink(writeAPI), BatchConfig{Size: 3, FlushInterval: time.Hour}, func(msgs []*Message) {
+		mu.Lock()
+		batches = append(batches, msgs)
+		mu.Unlock()
+		ackEach(msgs)
+	}, nil)
+
+	for id := 1; id <= 4; id++ {
+		writer.Add(testMetrics(1), acks.message(id))
+	}
+
+	waitFor(t, func() bool { return len(acks.Acked()) == 3 })
+	if len(writeAPI.Points()) != 3 {
+		t.Errorf("expected 3 points written, got %d", len(writeAPI.Points()))
+	}
+
+	if err := writer.Close(context.Background()); err != nil {
+		t.Fatalf("Close() returned error: %v", err)
+	}
+	if acked := acks.Acked(); !slices.Equal(acked, []int{1, 2, 3, 4}) {
+		t.Errorf("expected remaining message to be acked on close, got %v", acked)
+	}
+	if len(batches) != 2 || len(batches[0]) != 3 || len(batches[1]) != 1 {
+		t.Errorf("expected batches of 3 and 1 messages, got %d batches", len(batches))
+	}
+}
+
+func TestBatchWriter_FlushesOnInterval(t *testing.T) {
+	writeAPI := &fakeWriteAPI{}
+	acks := &ackLog{}
+	writer := NewBatchWriter(NewInfluxSink(writeAPI), BatchConfig{Size: 100, FlushInterval: 10 * time.Millisecond}, nil, nil)
+	defer writer.Close(context.Background())
+
+	writer.Add(testMetrics(2), acks.message(1))
+
+	waitFor(t, func() bool { return len(acks.Acked()) == 1 })
+	if len(writeAPI.Points()) != 2 {
+		t.Errorf("expected 2 points written, got %d", len(writeAPI.Points()))
+	}
+}
+
+func TestBatchWriter_AcksInOrder(t *testing.T) {
+	writeAPI := &gatedWriteAPI{gates: map[string]chan error{
+		"first":  make(chan error),
+		"second": make(chan error),
+	}}
+	acks := &ackLog{}
+	writer := NewBatchWriter(NewInfluxSink(writeAPI), BatchConfig{Size: 1, FlushInterval: time.Hour, MaxInFlight: 2}, nil, nil)
+
+	writer.Add([]*Metric{{Name: "first", Value: 1.0}}, acks.message(1))
+	writer.Add([]*Metric{{Name: "second", Value: 1.0}}, acks.message(2))
+
+	writeAPI.gates["second"] <- nil
+
+	time.Sleep(20 * time.Millisecond)
+	if acked := acks.Acked(); len(acked) != 0 {
+		t.Fatalf("expected no acks before the first batch completes, got %v", acked)
+	}
+
+	writeAPI.gates["first"] <- nil
+	if err := writer.Close(context.Background()); err != nil {
+		t.Fatalf("Close() returned error: %v", err)
+	}
+
+	if acked := acks.Acked(); !slices.Equal(acked, []int{1, 2}) {
+		t.Errorf("expected acks in order [1 2], got %v", acked)
+	}
+}
+
+func TestBatchWriter_FailedBatch(t *testing.T) {
+	writeErr := errors.New("influx down")
+	acks := &ackLog{}
+	first, second := acks.message(1), acks.message(2)
+
+	var mu sync.Mutex
+	var failed []*Message
+	writer := NewBatchWriter(NewInfluxSink(&fakeWriteAPI{err: writeErr}), BatchConfig{Size: 2, FlushInterval: time.Hour}, nil, func(msg *Message, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !errors.Is(err, writeErr) {
+			t.Errorf("expected write error, got %v", err)
+		}
+		failed = append(failed, msg)
+	})
+
+	writer.Add(testMetrics(1), first)
+	writer.Add(testMetrics(1), second)
+
+	if err := writer.Close(context.Background()); err != nil {
+		t.Fatalf("Close() returned error: %v", err)
+	}
+
+	if len(failed) != 2 || failed[0] != first || failed[1] != second {
+		t.Errorf("expected both messages to fail in order, got %v", failed)
+	}
+	if acked := acks.Acked(); len(acked) != 0 {
+		t.Errorf("expected no acks for failed batch, got %v", acked)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 1s")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
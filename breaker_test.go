@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestBreaker(threshold int, openTimeout time.Duration) (*CircuitBreaker, *time.Time) {
+	now := time.Date(2023, 10, 15, 14, 30, 45, 0, time.UTC)
+	breaker := NewCircuitBreaker(SinkInflux, CircuitBreakerConfig{FailureThreshold: threshold, OpenTimeout: openTimeout})
+	breaker.now = func() time.Time { return now }
+	return breaker, &now
+}
+
+func TestCircuitBreaker_Transitions(t *testing.T) {
+	breaker, now := newTestBreaker(3, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		breaker.Failure()
+	}
+	if breaker.State() != CircuitClosed || !breaker.Allow() {
+		t.Fatalf("expected breaker to stay closed below the threshold, got %v", breaker.State())
+	}
+
+	breaker.Failure()
+	if breaker.State() != CircuitOpen {
+		t.Fatalf("expected breaker to open at the threshold, got %v", breaker.State())
+	}
+	if breaker.Allow() {
+		t.Fatal("expected open breaker to refuse writes")
+	}
+	if state := testutil.ToFloat64(circuitState.WithLabelValues(SinkInflux)); state != float64(CircuitOpen) {
+		t.Errorf("expected circuit state gauge %d, got %v", CircuitOpen, state)
+	}
+
+	*now = now.Add(time.Minute)
+	if !breaker.Allow() {
+		t.Fatal("expected a probe once the open timeout passed")
+	}
+	if breaker.State() != CircuitHalfOpen {
+		t.Fatalf("expected half-open breaker, got %v", breaker.State())
+	}
+	if breaker.Allow() {
+		t.Fatal("expected only one probe while half-open")
+	}
+
+	breaker.Failure()
+	if breaker.State() != CircuitOpen {
+		t.Fatalf("expected failed probe to reopen the breaker, got %v", breaker.State())
+	}
+
+	*now = now.Add(time.Minute)
+	breaker.Allow()
+	breaker.Success()
+	if breaker.State() != CircuitClosed {
+		t.Fatalf("expected successful probe to close the breaker, got %v", breaker.State())
+	}
+}
+
+func TestCircuitBreaker_StatePerSink(t *testing.T) {
+	opened := testutil.ToFloat64(circuitTransitions.WithLabelValues("breaker-eu", "open"))
+	usOpened := testutil.ToFloat64(circuitTransitions.WithLabelValues("breaker-us", "open"))
+
+	eu := NewCircuitBreaker("breaker-eu", CircuitBreakerConfig{FailureThreshold: 1})
+	eu.Failure()
+	NewCircuitBreaker("breaker-us", CircuitBreakerConfig{FailureThreshold: 1})
+
+	if state := testutil.ToFloat64(circuitState.WithLabelValues("breaker-eu")); state != float64(CircuitOpen) {
+		t.Errorf("expected a new breaker to leave the eu state open, got %v", state)
+	}
+	if state := testutil.ToFloat64(circuitState.WithLabelValues("breaker-us")); state != float64(CircuitClosed) {
+		t.Errorf("expected us state closed, got %v", state)
+	}
+
+	if got := testutil.ToFloat64(circuitTransitions.WithLabelValues("breaker-eu", "open")) - opened; got != 1 {
+		t.Errorf("expected one transition to open for eu, got %v", got)
+	}
+	if got := testutil.ToFloat64(circuitTransitions.WithLabelValues("breaker-us", "open")) - usOpened; got != 0 {
+		t.Errorf("expected no transitions recorded for us, got %v", got)
+	}
+}
+
+func TestCircuitBreaker_SuccessResetsFailures(t *testing.T) {
+	breaker, _ := newTestBreaker(2, time.Minute)
+
+	breaker.Failure()
+	breaker.Success()
+	breaker.Failure()
+
+	if breaker.State() != CircuitClosed {
+		t.Errorf("expected non-consecutive failures to keep the breaker closed, got %v", breaker.State())
+	}
+}
+
+func TestCircuitBreaker_Wait(t *testing.T) {
+	breaker := NewCircuitBreaker(SinkInflux, CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: 30 * time.Millisecond})
+	if err := breaker.Wait(context.Background()); err != nil {
+		t.Fatalf("expected closed breaker not to block, got %v", err)
+	}
+
+	breaker.Failure()
+	start := time.Now()
+	if err := breaker.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait() returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("expected Wait() to block until the open timeout, returned after %v", elapsed)
+	}
+
+	breaker.Allow()
+	breaker.Failure()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := breaker.Wait(ctx); err == nil {
+		t.Error("expected Wait() to return the context error")
+	}
+}
@@ -1,15 +1,41 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
 
+	"github.com/charmbracelet/log"
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	defaultRabbitPort = 5672
+	guestCredentials  = "guest"
+)
+
 type Config struct {
 	InfluxdbConfig `yaml:"Influx"`
 	Rabbit RabbitConfig `yaml:"Rabbit"`
+	Kafka KafkaConfig `yaml:"Kafka"`
+	Mqtt MqttConfig `yaml:"Mqtt"`
+	Nats NatsConfig `yaml:"Nats"`
 	Api ApiConfig `yaml:"Api"`
+	Admin AdminConfig `yaml:"Admin"`
+	Wal WalConfig `yaml:"Wal"`
+	Validation ValidationConfig `yaml:"Validation"`
+	Logging LogConfig `yaml:"Logging"`
+	Sinks []SinkConfig `yaml:"Sinks"`
+	ShutdownTimeout time.Duration `yaml:"ShutdownTimeout"`
+	MaxDecompressedSize int64 `yaml:"MaxDecompressedSize"`
+	// Dev enables conveniences meant for a local broker only, such as the
+	// guest RabbitMQ credentials.
+	Dev bool `yaml:"Dev"`
 }
 
 type InfluxdbConfig struct {
@@ -17,6 +43,26 @@ type InfluxdbConfig struct {
 	Token string `yaml:"token"`
 	Org string `yaml:"org"`
 	Bucket string `yaml:"bucket"`
+	Batch BatchConfig `yaml:"batch"`
+	Retry RetryConfig `yaml:"retry"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuitBreaker"`
+}
+
+type BatchConfig struct {
+	Size int `yaml:"size"`
+	FlushInterval time.Duration `yaml:"flushInterval"`
+	MaxInFlight int `yaml:"maxInFlight"`
+}
+
+type RetryConfig struct {
+	MaxAttempts int `yaml:"maxAttempts"`
+	InitialDelay time.Duration `yaml:"initialDelay"`
+	MaxDelay time.Duration `yaml:"maxDelay"`
+}
+
+type CircuitBreakerConfig struct {
+	FailureThreshold int `yaml:"failureThreshold"`
+	OpenTimeout time.Duration `yaml:"openTimeout"`
 }
 
 type RabbitConfig struct {
@@ -25,24 +71,494 @@ type RabbitConfig struct {
 	Username string `yaml:"Username"`
 	Password string `yaml:"Password"`
 	Port int `yaml:"Port"`
+	Prefetch int `yaml:"Prefetch"`
+	ReconnectDelay time.Duration `yaml:"ReconnectDelay"`
+	MaxReconnectDelay time.Duration `yaml:"MaxReconnectDelay"`
+	ExchangeType string `yaml:"ExchangeType"`
+	ExchangeDurable bool `yaml:"ExchangeDurable"`
+	RoutingKeys []string `yaml:"RoutingKeys"`
+	BindArguments map[string]any `yaml:"BindArguments"`
+	Queue QueueConfig `yaml:"Queue"`
+	DeadLetter DeadLetterConfig `yaml:"DeadLetter"`
+	Format string `yaml:"Format"`
+	Time TimeConfig `yaml:"Time"`
+}
+
+type QueueConfig struct {
+	Name string `yaml:"Name"`
+	Durable bool `yaml:"Durable"`
+	AutoDelete bool `yaml:"AutoDelete"`
+	Exclusive bool `yaml:"Exclusive"`
+	Type string `yaml:"Type"`
+	MessageTTL time.Duration `yaml:"MessageTTL"`
+	MaxLength int `yaml:"MaxLength"`
+	Arguments map[string]any `yaml:"Arguments"`
+}
+
+type DeadLetterConfig struct {
+	Exchange string `yaml:"Exchange"`
+	Queue string `yaml:"Queue"`
+	RoutingKey string `yaml:"RoutingKey"`
+	MaxRetries int `yaml:"MaxRetries"`
+	// RetryDelay is how long a failed delivery waits before it is consumed
+	// again, doubling with every retry up to MaxRetryDelay.
+	RetryDelay time.Duration `yaml:"RetryDelay"`
+	MaxRetryDelay time.Duration `yaml:"MaxRetryDelay"`
+}
+
+type KafkaConfig struct {
+	Brokers []string `yaml:"Brokers"`
+	GroupID string `yaml:"GroupID"`
+	Topics []string `yaml:"Topics"`
+	StartOffset string `yaml:"StartOffset"`
+	MaxRetries int `yaml:"MaxRetries"`
+	DeadLetterTopic string `yaml:"DeadLetterTopic"`
+	Format string `yaml:"Format"`
+	Time TimeConfig `yaml:"Time"`
+}
+
+type MqttConfig struct {
+	Broker string `yaml:"Broker"`
+	ClientID string `yaml:"ClientID"`
+	Username string `yaml:"Username"`
+	Password string `yaml:"Password"`
+	Topics []string `yaml:"Topics"`
+	QoS int `yaml:"QoS"`
+	PersistentSession bool `yaml:"PersistentSession"`
+	TopicTemplate string `yaml:"TopicTemplate"`
+	MaxRetries int `yaml:"MaxRetries"`
+	DeadLetterTopic string `yaml:"DeadLetterTopic"`
+	Format string `yaml:"Format"`
+	Time TimeConfig `yaml:"Time"`
+}
+
+// NatsConfig subscribes to core subjects, or consumes them through a durable
+// JetStream consumer when Stream is set.
+type NatsConfig struct {
+	Url string `yaml:"Url"`
+	Username string `yaml:"Username"`
+	Password string `yaml:"Password"`
+	Token string `yaml:"Token"`
+	Subjects []string `yaml:"Subjects"`
+	Queue string `yaml:"Queue"`
+	Stream string `yaml:"Stream"`
+	Durable string `yaml:"Durable"`
+	MaxRetries int `yaml:"MaxRetries"`
+	SubjectTemplate string `yaml:"SubjectTemplate"`
+	DeadLetterSubject string `yaml:"DeadLetterSubject"`
+	Format string `yaml:"Format"`
+	Time TimeConfig `yaml:"Time"`
+}
+
+type WalConfig struct {
+	Dir string `yaml:"Dir"`
+	SegmentSize int64 `yaml:"SegmentSize"`
+	MaxSize int64 `yaml:"MaxSize"`
+	ReplayInterval time.Duration `yaml:"ReplayInterval"`
+}
+
+// SinkConfig describes one destination metrics are written to. Without any
+// sinks configured the Influx and Wal sections form a single required sink.
+type SinkConfig struct {
+	Name string `yaml:"Name"`
+	Type string `yaml:"Type"`
+	Policy string `yaml:"Policy"`
+	Influx InfluxdbConfig `yaml:"Influx"`
+	Wal WalConfig `yaml:"Wal"`
+	File FileSinkConfig `yaml:"File"`
+}
+
+type FileSinkConfig struct {
+	Path string `yaml:"Path"`
+}
+
+type ValidationConfig struct {
+	Strict bool `yaml:"Strict"`
+	NamePattern string `yaml:"NamePattern"`
+	AllowedTypes []string `yaml:"AllowedTypes"`
+	MaxTags int `yaml:"MaxTags"`
+	MaxTagKeyLength int `yaml:"MaxTagKeyLength"`
+	MaxTagValueLength int `yaml:"MaxTagValueLength"`
+}
+
+// LogConfig sets up the logger. Body controls whether received bodies are
+// logged off, truncated to BodyLimit bytes, or in full.
+type LogConfig struct {
+	Level string `yaml:"Level"`
+	Format string `yaml:"Format"`
+	Body string `yaml:"Body"`
+	BodyLimit int `yaml:"BodyLimit"`
+	Sampling LogSamplingConfig `yaml:"Sampling"`
+}
+
+// LogSamplingConfig logs the first Initial received messages of every second
+// and then every Thereafter-th one. Failures are never sampled.
+type LogSamplingConfig struct {
+	Initial int `yaml:"Initial"`
+	Thereafter int `yaml:"Thereafter"`
 }
 
 type ApiConfig struct {
 	Host string `yaml:"Host"`
 	Port int `yaml:"Port"`
+	MaxBodySize int64 `yaml:"MaxBodySize"`
+	MaxDecompressedSize int64 `yaml:"MaxDecompressedSize"`
+	// ReadTimeout bounds reading a whole request, body included.
+	ReadTimeout time.Duration `yaml:"ReadTimeout"`
+	Format string `yaml:"Format"`
+	Time TimeConfig `yaml:"Time"`
+}
+
+// AdminConfig serves carrot's own metrics on a listener of their own, apart
+// from the ingest api.
+type AdminConfig struct {
+	Host string `yaml:"Host"`
+	Port int `yaml:"Port"`
+}
+
+type TimeConfig struct {
+	Precision string `yaml:"Precision"`
+	Layouts []string `yaml:"Layouts"`
+	DefaultToNow bool `yaml:"DefaultToNow"`
 }
 
+// ReadConfig reads the YAML file at path, expanding ${VAR} references in its
+// values, and then applies the CARROT_ environment overrides and the defaults
+// on top. Keys that match no field are reported together as a
+// *ValidationError.
 func ReadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	var cfg Config
-	err = yaml.Unmarshal(data, &cfg)
+	var root yaml.Node
+	err = yaml.Unmarshal(data, &root)
 	if err != nil {
 		return nil, err
 	}
 
+	var cfg Config
+	result := &ValidationError{}
+	if root.Kind != 0 {
+		if err := interpolateEnv(&root, ""); err != nil {
+			return nil, err
+		}
+
+		unknownFields(result, &root, reflect.TypeOf(cfg), "")
+		if err := root.Decode(&cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyEnv(&cfg); err != nil {
+		return nil, err
+	}
+
+	cfg.applyDefaults()
+
+	// Report unknown fields along with everything else that is wrong, so a
+	// typo does not hide the problems it causes.
+	if len(result.Issues) > 0 {
+		var invalid *ValidationError
+		if errors.As(cfg.Validate(), &invalid) {
+			result.Issues = append(result.Issues, invalid.Issues...)
+		}
+
+		return nil, result
+	}
+
 	return &cfg, nil
 }
+
+func (cfg *Config) applyDefaults() {
+	if cfg.Rabbit.Host == "" {
+		return
+	}
+
+	if cfg.Rabbit.Port == 0 {
+		cfg.Rabbit.Port = defaultRabbitPort
+	}
+
+	if cfg.Dev && cfg.Rabbit.Username == "" && cfg.Rabbit.Password == "" {
+		cfg.Rabbit.Username = guestCredentials
+		cfg.Rabbit.Password = guestCredentials
+	}
+}
+
+// unknownFields adds an issue for every mapping key in node that has no field
+// in t, suggesting the closest field when the key looks like a typo.
+func unknownFields(result *ValidationError, node *yaml.Node, t reflect.Type, path string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case node.Kind == yaml.DocumentNode:
+		for _, child := range node.Content {
+			unknownFields(result, child, t, path)
+		}
+	case node.Kind == yaml.SequenceNode && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array):
+		for i, child := range node.Content {
+			unknownFields(result, child, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := make(map[string]reflect.Type, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			key, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+			if key != "" && key != "-" {
+				fields[key] = t.Field(i).Type
+			}
+		}
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			fieldType, ok := fields[key.Value]
+			if !ok {
+				message := fmt.Sprintf("unknown field on line %d", key.Line)
+				if suggestion := closestField(key.Value, fields); suggestion != "" {
+					message += fmt.Sprintf(", did you mean %s?", suggestion)
+				}
+				result.add(joinPath(path, key.Value), "%s", message)
+				continue
+			}
+
+			unknownFields(result, node.Content[i+1], fieldType, joinPath(path, key.Value))
+		}
+	}
+}
+
+func closestField(key string, fields map[string]reflect.Type) string {
+	best, bestDistance := "", 3
+	for field := range fields {
+		if strings.EqualFold(field, key) {
+			return field
+		}
+
+		if distance := editDistance(strings.ToLower(key), strings.ToLower(field)); distance < bestDistance {
+			best, bestDistance = field, distance
+		}
+	}
+
+	return best
+}
+
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+
+	return previous[len(b)]
+}
+
+// Validate reports every problem in cfg at once, each with the YAML path of
+// the offending field, so a broken config fails at startup rather than at the
+// first connection or write.
+func (cfg *Config) Validate() error {
+	result := &ValidationError{}
+
+	if cfg.Rabbit.Host == "" && len(cfg.Kafka.Brokers) == 0 && cfg.Mqtt.Broker == "" && cfg.Nats.Url == "" && cfg.Api.Port == 0 {
+		result.add("(root)", "no source configured, set up Rabbit, Kafka, Mqtt, Nats or Api")
+	}
+
+	if len(cfg.Sinks) == 0 {
+		validateInflux(result, "Influx", cfg.InfluxdbConfig)
+	} else if cfg.Wal != (WalConfig{}) {
+		result.add("Wal", "is ignored once Sinks are set, configure Wal on each sink instead")
+	}
+
+	names := make(map[string]bool)
+	walDirs := make(map[string]string)
+	for i, sink := range cfg.Sinks {
+		path := fmt.Sprintf("Sinks[%d]", i)
+		if sink.Name != "" {
+			if names[sink.Name] {
+				result.add(path+".Name", "duplicate sink name %q", sink.Name)
+			}
+			names[sink.Name] = true
+		}
+
+		if _, err := sinkRequired(sink.Policy); err != nil {
+			result.add(path+".Policy", "%v", err)
+		}
+
+		switch sink.Type {
+		case "", SinkInflux:
+			validateInflux(result, path+".Influx", sink.Influx)
+
+			// Two wals in one directory would replay and delete each
+			// other's segments.
+			if sink.Wal.Dir != "" {
+				dir := filepath.Clean(sink.Wal.Dir)
+				if other, ok := walDirs[dir]; ok {
+					result.add(path+".Wal.Dir", "%q is already used by %s, every sink needs its own wal", sink.Wal.Dir, other)
+				}
+				walDirs[dir] = path
+			}
+		case SinkFile:
+			if sink.File.Path == "" {
+				result.add(path+".File.Path", "is required for file sinks")
+			}
+		default:
+			result.add(path+".Type", "unsupported sink type %q, expected %s or %s", sink.Type, SinkInflux, SinkFile)
+		}
+	}
+
+	if cfg.Rabbit.Host != "" {
+		validatePort(result, "Rabbit.Port", cfg.Rabbit.Port)
+		if _, err := rabbitExchangeType(cfg.Rabbit.ExchangeType); err != nil {
+			result.add("Rabbit.ExchangeType", "%v", err)
+		}
+
+		switch {
+		case cfg.Rabbit.Username == "" && !cfg.Dev:
+			result.add("Rabbit.Username", "is required, guest credentials are only used with Dev set")
+		case cfg.Rabbit.Username == guestCredentials && !cfg.Dev:
+			result.add("Rabbit.Username", "guest credentials are only allowed with Dev set")
+		}
+
+		if cfg.Rabbit.Queue.Name == "" && (cfg.Rabbit.Queue.Durable || (cfg.Rabbit.Queue.Type != "" && cfg.Rabbit.Queue.Type != "classic")) {
+			result.add("Rabbit.Queue.Name", "is required for durable, quorum and stream queues, server-named queues are exclusive and auto-deleted")
+		}
+
+		validateFormat(result, "Rabbit", cfg.Rabbit.Format, cfg.Rabbit.Time)
+	}
+
+	if len(cfg.Kafka.Brokers) > 0 {
+		if len(cfg.Kafka.Topics) == 0 {
+			result.add("Kafka.Topics", "needs at least one topic")
+		}
+		if _, err := kafkaStartOffset(cfg.Kafka.StartOffset); err != nil {
+			result.add("Kafka.StartOffset", "%v", err)
+		}
+
+		validateFormat(result, "Kafka", cfg.Kafka.Format, cfg.Kafka.Time)
+	}
+
+	if cfg.Mqtt.Broker != "" {
+		if len(cfg.Mqtt.Topics) == 0 {
+			result.add("Mqtt.Topics", "needs at least one topic filter")
+		}
+		if cfg.Mqtt.QoS < 0 || cfg.Mqtt.QoS > 2 {
+			result.add("Mqtt.QoS", "must be 0, 1 or 2, got %d", cfg.Mqtt.QoS)
+		}
+		if _, err := ParseTopicTemplate(cfg.Mqtt.TopicTemplate, "/", "+", "#"); err != nil {
+			result.add("Mqtt.TopicTemplate", "%v", err)
+		}
+
+		validateFormat(result, "Mqtt", cfg.Mqtt.Format, cfg.Mqtt.Time)
+	}
+
+	if cfg.Nats.Url != "" {
+		if len(cfg.Nats.Subjects) == 0 {
+			result.add("Nats.Subjects", "needs at least one subject")
+		}
+		if _, err := ParseTopicTemplate(cfg.Nats.SubjectTemplate, ".", "*", ">"); err != nil {
+			result.add("Nats.SubjectTemplate", "%v", err)
+		}
+
+		validateFormat(result, "Nats", cfg.Nats.Format, cfg.Nats.Time)
+	}
+
+	if cfg.Api.Port != 0 {
+		validatePort(result, "Api.Port", cfg.Api.Port)
+		validateFormat(result, "Api", cfg.Api.Format, cfg.Api.Time)
+		if cfg.Api.ReadTimeout < 0 {
+			result.add("Api.ReadTimeout", "must not be negative")
+		}
+	}
+
+	if cfg.Admin.Port != 0 {
+		validatePort(result, "Admin.Port", cfg.Admin.Port)
+		if cfg.Admin.Port == cfg.Api.Port && cfg.Admin.Host == cfg.Api.Host {
+			result.add("Admin.Port", "is already used by Api.Port")
+		}
+	}
+
+	if _, err := NewValidator(cfg.Validation); err != nil {
+		result.add("Validation", "%v", err)
+	}
+
+	if cfg.Logging.Level != "" {
+		if _, err := log.ParseLevel(cfg.Logging.Level); err != nil {
+			result.add("Logging.Level", "%v", err)
+		}
+	}
+	if _, ok := logFormatters[cfg.Logging.Format]; !ok && cfg.Logging.Format != "" {
+		result.add("Logging.Format", "unsupported log format %q, expected %s, %s or %s", cfg.Logging.Format, LogFormatText, LogFormatJSON, LogFormatLogfmt)
+	}
+	if _, err := NewMessageLog(cfg.Logging); err != nil {
+		result.add("Logging.Body", "%v", err)
+	}
+
+	if cfg.ShutdownTimeout < 0 {
+		result.add("ShutdownTimeout", "must not be negative")
+	}
+
+	if len(result.Issues) > 0 {
+		return result
+	}
+
+	return nil
+}
+
+func validateInflux(result *ValidationError, path string, cfg InfluxdbConfig) {
+	if cfg.Url == "" {
+		result.add(path+".url", "is required")
+	} else if u, err := url.Parse(cfg.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		result.add(path+".url", "must be an http or https url, got %q", cfg.Url)
+	}
+
+	if cfg.Org == "" {
+		result.add(path+".org", "is required")
+	}
+
+	if cfg.Bucket == "" {
+		result.add(path+".bucket", "is required")
+	}
+
+	if cfg.Batch.Size < 0 {
+		result.add(path+".batch.size", "must not be negative")
+	}
+}
+
+func validatePort(result *ValidationError, path string, port int) {
+	if port < 1 || port > 65535 {
+		result.add(path, "must be between 1 and 65535, got %d", port)
+	}
+}
+
+func validateFormat(result *ValidationError, path string, format string, timeCfg TimeConfig) {
+	if _, err := LookupDecoder("", format); err != nil {
+		result.add(path+".Format", "%v", err)
+	}
+
+	if _, ok := precisions[timeCfg.Precision]; !ok && timeCfg.Precision != "" {
+		result.add(path+".Time.Precision", "unsupported timestamp precision %q, expected s, ms, us or ns", timeCfg.Precision)
+	}
+}
+
+// CheckConfig reads and validates the config at path, as carrot does at
+// startup, and returns every problem found.
+func CheckConfig(path string) error {
+	cfg, err := ReadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	return cfg.Validate()
+}
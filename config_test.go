@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"os"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
 )
 
 func TestReadConfig_ValidFile(t *testing.T) {
@@ -12,15 +20,42 @@ Influx:
   token: "my-token"
   org: "my-org"
   bucket: "my-bucket"
+  batch:
+    size: 500
+    flushInterval: 2s
+    maxInFlight: 4
 Rabbit:
   Channel: "my-channel"
   Host: "localhost"
   Username: "guest"
   Password: "guest"
   Port: 5672
+  ExchangeType: "topic"
+  RoutingKeys: ["metrics.#"]
+  Queue:
+    Name: "carrot"
+    Durable: true
+    Type: "quorum"
+    MessageTTL: 1h
+    MaxLength: 10000
+Kafka:
+  Brokers: ["kafka-1:9092", "kafka-2:9092"]
+  GroupID: "carrot-eu"
+  Topics: ["metrics"]
+  DeadLetterTopic: "metrics-dlq"
 Api:
   Host: "0.0.0.0"
   Port: 8080
+Sinks:
+  - Name: "eu"
+    Influx:
+      url: "http://influx-eu:8086"
+      bucket: "metrics"
+  - Name: "audit"
+    Type: "file"
+    Policy: "best-effort"
+    File:
+      Path: "/var/log/carrot/metrics.lp"
 `
 
 	tmpFile, err := os.CreateTemp("", "config-*.yaml")
@@ -53,16 +88,57 @@ Api:
 		t.Errorf("Expected Influx.Bucket 'my-bucket', got '%s'", cfg.InfluxdbConfig.Bucket)
 	}
 
+	if cfg.InfluxdbConfig.Batch != (BatchConfig{Size: 500, FlushInterval: 2 * time.Second, MaxInFlight: 4}) {
+		t.Errorf("Expected Influx.Batch {500 2s 4}, got %+v", cfg.InfluxdbConfig.Batch)
+	}
+
 	// Rabbit checks
 	if cfg.Rabbit.Channel != "my-channel" {
 		t.Errorf("Expected Rabbit.Channel 'my-channel', got '%s'", cfg.Rabbit.Channel)
 	}
+	if cfg.Rabbit.ExchangeType != "topic" {
+		t.Errorf("Expected Rabbit.ExchangeType 'topic', got '%s'", cfg.Rabbit.ExchangeType)
+	}
+	if len(cfg.Rabbit.RoutingKeys) != 1 || cfg.Rabbit.RoutingKeys[0] != "metrics.#" {
+		t.Errorf("Expected Rabbit.RoutingKeys [metrics.#], got %v", cfg.Rabbit.RoutingKeys)
+	}
+	if cfg.Rabbit.Queue.Name != "carrot" || !cfg.Rabbit.Queue.Durable {
+		t.Errorf("Expected durable Rabbit.Queue 'carrot', got %+v", cfg.Rabbit.Queue)
+	}
+	if cfg.Rabbit.Queue.Type != "quorum" {
+		t.Errorf("Expected Rabbit.Queue.Type 'quorum', got '%s'", cfg.Rabbit.Queue.Type)
+	}
+	if cfg.Rabbit.Queue.MessageTTL != time.Hour {
+		t.Errorf("Expected Rabbit.Queue.MessageTTL 1h, got %v", cfg.Rabbit.Queue.MessageTTL)
+	}
+	if cfg.Rabbit.Queue.MaxLength != 10000 {
+		t.Errorf("Expected Rabbit.Queue.MaxLength 10000, got %d", cfg.Rabbit.Queue.MaxLength)
+	}
 	if cfg.Api.Port != 8080 {
 		t.Errorf("Expected Api.Port 8080, got %d", cfg.Api.Port)
 	}
 	if cfg.Api.Host != "0.0.0.0" {
 		t.Errorf("Expected Api.Host '0.0.0.0', got '%s'", cfg.Api.Host)
 	}
+
+	// Kafka checks
+	if len(cfg.Kafka.Brokers) != 2 || cfg.Kafka.GroupID != "carrot-eu" || cfg.Kafka.DeadLetterTopic != "metrics-dlq" {
+		t.Errorf("Expected Kafka source for group 'carrot-eu', got %+v", cfg.Kafka)
+	}
+	if len(cfg.Kafka.Topics) != 1 || cfg.Kafka.Topics[0] != "metrics" {
+		t.Errorf("Expected Kafka.Topics [metrics], got %v", cfg.Kafka.Topics)
+	}
+
+	// Sink checks
+	if len(cfg.Sinks) != 2 {
+		t.Fatalf("Expected 2 sinks, got %d", len(cfg.Sinks))
+	}
+	if cfg.Sinks[0].Name != "eu" || cfg.Sinks[0].Influx.Url != "http://influx-eu:8086" {
+		t.Errorf("Expected influx sink 'eu', got %+v", cfg.Sinks[0])
+	}
+	if cfg.Sinks[1].Type != SinkFile || cfg.Sinks[1].Policy != PolicyBestEffort || cfg.Sinks[1].File.Path != "/var/log/carrot/metrics.lp" {
+		t.Errorf("Expected best-effort file sink, got %+v", cfg.Sinks[1])
+	}
 }
 
 func TestReadConfig_FileNotFound(t *testing.T) {
@@ -107,3 +183,262 @@ Api:
 	}
 }
 
+func TestReadConfig_UnknownFields(t *testing.T) {
+	path := writeConfig(t, `
+Rabbit:
+  Host: localhost
+  Usename: carrot
+  Queue:
+    Nmae: carrot
+Sinks:
+  - Name: eu
+    Influx:
+      URL: "http://influx-eu:8086"
+Bogus: true
+`)
+
+	_, err := ReadConfig(path)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected *ValidationError, got %v", err)
+	}
+
+	expected := map[string]string{
+		"Rabbit.Usename":      "did you mean Username?",
+		"Rabbit.Queue.Nmae":   "did you mean Name?",
+		"Sinks[0].Influx.URL": "did you mean url?",
+		"Bogus":               "unknown field on line 11",
+	}
+	found := make(map[string]bool)
+	for _, issue := range validationErr.Issues {
+		if message, ok := expected[issue.Path]; ok {
+			found[issue.Path] = true
+			if !strings.Contains(issue.Message, message) {
+				t.Errorf("unexpected issue %s: %s", issue.Path, issue.Message)
+			}
+		}
+	}
+	if len(found) != len(expected) {
+		t.Errorf("expected issues for %v, got %+v", expected, validationErr.Issues)
+	}
+}
+
+func TestReadConfig_UnknownFieldsWithValidationIssues(t *testing.T) {
+	path := writeConfig(t, `
+Influx:
+  token: secret
+  org: carrot
+  bucket: metrics
+  URL: "http://localhost:8086"
+Rabbit:
+  Host: localhost
+`)
+
+	_, err := ReadConfig(path)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected *ValidationError, got %v", err)
+	}
+
+	paths := make([]string, len(validationErr.Issues))
+	for i, issue := range validationErr.Issues {
+		paths[i] = issue.Path
+	}
+	if !slices.Contains(paths, "Influx.URL") || !slices.Contains(paths, "Influx.url") {
+		t.Errorf("expected the unknown field and the missing url in one report, got %+v", validationErr.Issues)
+	}
+}
+
+func TestReadConfig_Defaults(t *testing.T) {
+	cfg, err := ReadConfig(writeConfig(t, "Rabbit:\n  Host: localhost\n"))
+	if err != nil {
+		t.Fatalf("ReadConfig() unexpected error: %v", err)
+	}
+	if cfg.Rabbit.Port != defaultRabbitPort {
+		t.Errorf("expected default port %d, got %d", defaultRabbitPort, cfg.Rabbit.Port)
+	}
+	if cfg.Rabbit.Username != "" || cfg.Rabbit.Password != "" {
+		t.Errorf("expected no credentials outside dev mode, got %s/%s", cfg.Rabbit.Username, cfg.Rabbit.Password)
+	}
+
+	cfg, err = ReadConfig(writeConfig(t, "Dev: true\nRabbit:\n  Host: localhost\n"))
+	if err != nil {
+		t.Fatalf("ReadConfig() unexpected error: %v", err)
+	}
+	if cfg.Rabbit.Username != "guest" || cfg.Rabbit.Password != "guest" {
+		t.Errorf("expected guest credentials in dev mode, got %s/%s", cfg.Rabbit.Username, cfg.Rabbit.Password)
+	}
+}
+
+func validConfig() *Config {
+	return &Config{
+		InfluxdbConfig: InfluxdbConfig{Url: "http://localhost:8086", Org: "my-org", Bucket: "my-bucket"},
+		Rabbit:         RabbitConfig{Host: "localhost", Port: 5672, Username: "carrot", Password: "secret"},
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("Validate() unexpected error: %v", err)
+	}
+
+	dev := validConfig()
+	dev.Dev = true
+	dev.Rabbit.Username, dev.Rabbit.Password = "guest", "guest"
+	if err := dev.Validate(); err != nil {
+		t.Errorf("expected guest credentials to be allowed in dev mode, got %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		mutate   func(cfg *Config)
+		expected []string
+	}{
+		{
+			name: "no source",
+			mutate: func(cfg *Config) {
+				cfg.Rabbit = RabbitConfig{}
+			},
+			expected: []string{"(root)"},
+		},
+		{
+			name: "influx",
+			mutate: func(cfg *Config) {
+				cfg.InfluxdbConfig = InfluxdbConfig{Url: "localhost:8086"}
+			},
+			expected: []string{"Influx.url", "Influx.org", "Influx.bucket"},
+		},
+		{
+			name: "rabbit",
+			mutate: func(cfg *Config) {
+				cfg.Rabbit.Port = 70000
+				cfg.Rabbit.Username = "guest"
+				cfg.Rabbit.ExchangeType = "fan"
+				cfg.Rabbit.Format = "xml"
+				cfg.Rabbit.Time.Precision = "m"
+				cfg.Rabbit.Queue.Durable = true
+			},
+			expected: []string{"Rabbit.Port", "Rabbit.ExchangeType", "Rabbit.Username", "Rabbit.Queue.Name", "Rabbit.Format", "Rabbit.Time.Precision"},
+		},
+		{
+			name: "sources",
+			mutate: func(cfg *Config) {
+				cfg.Kafka = KafkaConfig{Brokers: []string{"kafka:9092"}, StartOffset: "middle"}
+				cfg.Mqtt = MqttConfig{Broker: "tcp://mqtt:1883", QoS: 3}
+				cfg.Nats = NatsConfig{Url: "nats://nats:4222"}
+			},
+			expected: []string{"Kafka.Topics", "Kafka.StartOffset", "Mqtt.Topics", "Mqtt.QoS", "Nats.Subjects"},
+		},
+		{
+			name: "sinks",
+			mutate: func(cfg *Config) {
+				cfg.Sinks = []SinkConfig{
+					{Name: "eu", Influx: cfg.InfluxdbConfig},
+					{Name: "eu", Type: SinkFile, Policy: "sometimes"},
+					{Type: "s3"},
+				}
+			},
+			expected: []string{"Sinks[1].Name", "Sinks[1].Policy", "Sinks[1].File.Path", "Sinks[2].Type"},
+		},
+		{
+			name: "sink wals",
+			mutate: func(cfg *Config) {
+				cfg.Wal = WalConfig{Dir: "/var/lib/carrot/wal"}
+				cfg.Sinks = []SinkConfig{
+					{Name: "eu", Influx: cfg.InfluxdbConfig, Wal: WalConfig{Dir: "/var/lib/carrot/wal"}},
+					{Name: "us", Influx: cfg.InfluxdbConfig, Wal: WalConfig{Dir: "/var/lib/carrot/wal/"}},
+					{Name: "apac", Influx: cfg.InfluxdbConfig, Wal: WalConfig{Dir: "/var/lib/carrot/wal-apac"}},
+				}
+			},
+			expected: []string{"Wal", "Sinks[1].Wal.Dir"},
+		},
+		{
+			name: "listeners and logging",
+			mutate: func(cfg *Config) {
+				cfg.Api.Port = 8080
+				cfg.Admin.Port = 8080
+				cfg.Logging = LogConfig{Level: "loud", Format: "xml", Body: "some"}
+				cfg.Validation = ValidationConfig{Strict: true, NamePattern: "["}
+			},
+			expected: []string{"Admin.Port", "Validation", "Logging.Level", "Logging.Format", "Logging.Body"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			tt.mutate(cfg)
+
+			var validationErr *ValidationError
+			if !errors.As(cfg.Validate(), &validationErr) {
+				t.Fatal("expected *ValidationError")
+			}
+
+			var paths []string
+			for _, issue := range validationErr.Issues {
+				paths = append(paths, issue.Path)
+			}
+			if strings.Join(paths, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected issues at %v, got %+v", tt.expected, validationErr.Issues)
+			}
+		})
+	}
+}
+
+func TestRunCommand_ConfigCheck(t *testing.T) {
+	valid := writeConfig(t, `
+Influx:
+  url: "http://localhost:8086"
+  org: "my-org"
+  bucket: "my-bucket"
+Api:
+  Port: 8080
+`)
+	invalid := writeConfig(t, `
+Influx:
+  url: "http://localhost:8086"
+Rabbit:
+  Host: localhost
+`)
+
+	tests := []struct {
+		name         string
+		args         []string
+		expectedCode int
+		expectedOut  []string
+	}{
+		{name: "valid", args: []string{"config", "check"}, expectedCode: 0, expectedOut: []string{valid + ": ok"}},
+		{name: "invalid path argument", args: []string{"config", "check", invalid}, expectedCode: 1, expectedOut: []string{"Influx.org: is required", "Influx.bucket: is required", "Rabbit.Username: is required"}},
+		{name: "missing file", args: []string{"config", "check", "nonexistent.yaml"}, expectedCode: 1, expectedOut: []string{"nonexistent.yaml"}},
+		{name: "unknown command", args: []string{"serve"}, expectedCode: 2, expectedOut: []string{"usage"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if code := runCommand(tt.args, valid, &out); code != tt.expectedCode {
+				t.Errorf("expected exit code %d, got %d", tt.expectedCode, code)
+			}
+
+			for _, expected := range tt.expectedOut {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("expected output to contain %q, got:\n%s", expected, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRun_InvalidConfigExitsWithFailure(t *testing.T) {
+	previous := Log
+	Log = log.New(io.Discard)
+	defer func() { Log = previous }()
+
+	invalid := writeConfig(t, "Rabbit:\n  Host: localhost\n")
+
+	for _, path := range []string{invalid, "nonexistent.yaml"} {
+		if code := run(path); code != 1 {
+			t.Errorf("expected exit code 1 for %s, got %d", path, code)
+		}
+	}
+}
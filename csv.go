@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatCSV = "csv"
+
+	csvFieldPrefix = "field."
+)
+
+func init() {
+	RegisterDecoder(FormatCSV, ParseCSV, "text/csv")
+}
+
+// ParseCSV reads one metric per row below a header row. The name, value and
+// time columns map to the metric itself, field.<key> columns become fields
+// and every other column is a tag. Numeric and true/false cells keep their
+// type, and rows with an empty time cell follow DefaultToNow.
+func ParseCSV(data []byte, cfg TimeConfig) ([]*Metric, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid csv header: %v", err)
+	}
+
+	if !slices.Contains(header, "name") {
+		return nil, fmt.Errorf("invalid csv header: missing name column")
+	}
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := make([]*Metric, 0, len(rows))
+	for i, row := range rows {
+		metric := &Metric{Tags: make(map[string]string)}
+		var timestamp any
+
+		for col, cell := range row {
+			switch key := header[col]; {
+			case key == "name":
+				metric.Name = cell
+			case key == "value":
+				if cell != "" {
+					metric.Value = csvValue(cell)
+				}
+			case key == "time":
+				timestamp = csvTime(cell)
+			case strings.HasPrefix(key, csvFieldPrefix):
+				if cell == "" {
+					continue
+				}
+				if metric.Fields == nil {
+					metric.Fields = make(map[string]any)
+				}
+				metric.Fields[strings.TrimPrefix(key, csvFieldPrefix)] = csvValue(cell)
+			default:
+				if cell != "" {
+					metric.Tags[key] = cell
+				}
+			}
+		}
+
+		metric.Timestamp, err = ParseTimeWith(timestamp, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp in row %d: %v", i+1, err)
+		}
+
+		metrics = append(metrics, metric)
+	}
+
+	return metrics, nil
+}
+
+func csvValue(cell string) any {
+	if f, err := strconv.ParseFloat(cell, 64); err == nil {
+		return f
+	}
+
+	switch cell {
+	case "true":
+		return true
+	case "false":
+		return false
+	default:
+		return cell
+	}
+}
+
+// csvTime keeps numeric cells as json.Number so epoch values are parsed
+// exactly in the configured precision.
+func csvTime(cell string) any {
+	if cell == "" {
+		return nil
+	}
+
+	if _, err := strconv.ParseFloat(cell, 64); err == nil {
+		return json.Number(cell)
+	}
+
+	return cell
+}
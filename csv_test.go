@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCSV(t *testing.T) {
+	data := []byte("name,time,value,host,field.user,field.system\n" +
+		"cpu_usage,2023-10-15T14:30:45Z,75.5,server1,,\n" +
+		"cpu,1697380245,,server2,12.5,3.1\n" +
+		"up,2023-10-15T14:30:45Z,true,,,\n")
+
+	metrics, err := ParseCSV(data, TimeConfig{})
+	if err != nil {
+		t.Fatalf("ParseCSV() unexpected error: %v", err)
+	}
+	if len(metrics) != 3 {
+		t.Fatalf("expected 3 metrics, got %d", len(metrics))
+	}
+
+	expectedTime := time.Date(2023, 10, 15, 14, 30, 45, 0, time.UTC)
+	expected := []*Metric{
+		{Name: "cpu_usage", Value: 75.5, Tags: map[string]string{"host": "server1"}, Timestamp: expectedTime},
+		{Name: "cpu", Fields: map[string]any{"user": 12.5, "system": 3.1}, Tags: map[string]string{"host": "server2"}, Timestamp: expectedTime},
+		{Name: "up", Value: true, Tags: map[string]string{}, Timestamp: expectedTime},
+	}
+
+	for i, metric := range metrics {
+		if !metric.Timestamp.Equal(expected[i].Timestamp) {
+			t.Errorf("metric %d: expected timestamp %v, got %v", i, expected[i].Timestamp, metric.Timestamp)
+		}
+		metric.Timestamp = expected[i].Timestamp
+		if !reflect.DeepEqual(metric, expected[i]) {
+			t.Errorf("metric %d: expected %+v, got %+v", i, expected[i], metric)
+		}
+	}
+}
+
+func TestParseCSV_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		cfg  TimeConfig
+	}{
+		{name: "empty body", data: ""},
+		{name: "missing name column", data: "value,time\n1,2023-10-15T14:30:45Z\n"},
+		{name: "ragged row", data: "name,value\ncpu,1,extra\n"},
+		{name: "missing timestamp", data: "name,value\ncpu,1\n"},
+		{name: "invalid timestamp", data: "name,value,time\ncpu,1,yesterday\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseCSV([]byte(tt.data), tt.cfg); err == nil {
+				t.Error("expected error but got none")
+			}
+		})
+	}
+}
+
+func TestParseCSV_DefaultToNow(t *testing.T) {
+	metrics, err := DecodeMessage([]byte("name,value\ncpu,1\n"), "text/csv", "", TimeConfig{DefaultToNow: true})
+	if err != nil {
+		t.Fatalf("DecodeMessage() unexpected error: %v", err)
+	}
+	if len(metrics) != 1 || time.Since(metrics[0].Timestamp) > time.Second {
+		t.Errorf("expected one metric stamped now, got %+v", metrics)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultMaxRetries    = 3
+	defaultRetryDelay    = 5 * time.Second
+	defaultMaxRetryDelay = 5 * time.Minute
+
+	retryQueuePrefix = "carrot.retry."
+
+	retriesHeader    = "x-carrot-retries"
+	errorHeader      = "x-carrot-error"
+	errorStageHeader = "x-carrot-error-stage"
+	validationHeader = "x-carrot-validation-errors"
+
+	StageParse = "parse"
+	StageWrite = "write"
+)
+
+var ErrPublishUnconfirmed = errors.New("publish was not confirmed by the broker")
+
+func declareDeadLetter(ch *amqp.Channel, cfg DeadLetterConfig) error {
+	if cfg.Exchange == "" {
+		return nil
+	}
+
+	err := ch.ExchangeDeclare(
+		cfg.Exchange,
+		amqp.ExchangeFanout,
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	if cfg.Queue == "" {
+		return nil
+	}
+
+	_, err = ch.QueueDeclare(
+		cfg.Queue,
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return ch.QueueBind(
+		cfg.Queue,
+		"",
+		cfg.Exchange,
+		false,
+		nil,
+	)
+}
+
+// declareRetryQueue declares the queue failed deliveries of queue wait in. It
+// has no consumers, so every message stays until its expiration dead-letters
+// it back to queue through the default exchange. It lives as long as queue:
+// exclusive alongside an exclusive queue, durable alongside a durable one.
+func declareRetryQueue(ch *amqp.Channel, queue string, cfg QueueConfig) (string, error) {
+	name := retryQueuePrefix + queue
+	_, err := ch.QueueDeclare(
+		name,
+		cfg.Durable,
+		false,
+		cfg.Exclusive,
+		false,
+		amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue,
+		},
+	)
+
+	if err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// DeadLetter publishes msg to the configured dead-letter exchange with the
+// failure reason in its headers and acks the original. Without a dead-letter
+// exchange the delivery is rejected, leaving routing to the queue's own
+// x-dead-letter-exchange argument if it has one.
+func (c *RabbitConsumer) DeadLetter(msg amqp.Delivery, stage string, reason error) error {
+	cfg := c.cfg.Rabbit.DeadLetter
+	if cfg.Exchange == "" {
+		return msg.Reject(false)
+	}
+
+	return c.republish(msg, cfg.Exchange, cfg.RoutingKey, deadLetterPublishing(msg, stage, reason))
+}
+
+// Retry parks msg in the retry queue with an incremented retry count, from
+// where it returns to the consumed queue after a backoff, so an outage does
+// not use up its retries at once. It is dead-lettered instead once
+// MaxRetries is exhausted.
+func (c *RabbitConsumer) Retry(msg amqp.Delivery, stage string, reason error) error {
+	retries := deliveryRetries(msg)
+	if retries >= c.maxRetries() {
+		return c.DeadLetter(msg, stage, reason)
+	}
+
+	publishing := retryPublishing(msg, retries+1, c.retryDelay(retries+1))
+	return c.republish(msg, "", c.currentSession().retryQueue, publishing)
+}
+
+func (c *RabbitConsumer) retryDelay(attempt int) time.Duration {
+	cfg := c.cfg.Rabbit.DeadLetter
+
+	base := cfg.RetryDelay
+	if base <= 0 {
+		base = defaultRetryDelay
+	}
+
+	max := cfg.MaxRetryDelay
+	if max <= 0 {
+		max = defaultMaxRetryDelay
+	}
+
+	return backoffDelay(base, max, attempt)
+}
+
+func (c *RabbitConsumer) maxRetries() int {
+	if c.cfg.Rabbit.DeadLetter.MaxRetries <= 0 {
+		return defaultMaxRetries
+	}
+
+	return c.cfg.Rabbit.DeadLetter.MaxRetries
+}
+
+// republish acks msg once the broker has confirmed its copy, and requeues it
+// if the publish fails or is not confirmed so it is never lost.
+func (c *RabbitConsumer) republish(msg amqp.Delivery, exchange string, key string, publishing amqp.Publishing) error {
+	if err := c.currentSession().publish(exchange, key, publishing); err != nil {
+		return errors.Join(err, msg.Nack(false, true))
+	}
+
+	return msg.Ack(false)
+}
+
+func (s *rabbitSession) publish(exchange string, key string, publishing amqp.Publishing) error {
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+
+	if err := s.ch.Publish(exchange, key, false, false, publishing); err != nil {
+		return err
+	}
+
+	return awaitConfirm(s.confirms)
+}
+
+// awaitConfirm waits for the broker to confirm the last publish. The channel
+// is closed when the amqp channel is, leaving the publish unconfirmed.
+func awaitConfirm(confirms <-chan amqp.Confirmation) error {
+	confirm, ok := <-confirms
+	if !ok {
+		return ErrPublishUnconfirmed
+	}
+
+	if !confirm.Ack {
+		return fmt.Errorf("%w: broker nacked delivery %d", ErrPublishUnconfirmed, confirm.DeliveryTag)
+	}
+
+	return nil
+}
+
+// deadLetterPublishing copies msg with the failure stage and reason in its
+// headers, including one entry per issue for validation failures.
+func deadLetterPublishing(msg amqp.Delivery, stage string, reason error) amqp.Publishing {
+	publishing := failedPublishing(msg, deliveryRetries(msg))
+	publishing.Headers[errorHeader] = reason.Error()
+	publishing.Headers[errorStageHeader] = stage
+
+	var validationErr *ValidationError
+	if errors.As(reason, &validationErr) {
+		issues := make([]interface{}, len(validationErr.Issues))
+		for i, issue := range validationErr.Issues {
+			issues[i] = amqp.Table{"path": issue.Path, "message": issue.Message}
+		}
+		publishing.Headers[validationHeader] = issues
+	}
+
+	return publishing
+}
+
+// retryPublishing copies msg to wait delay in the retry queue. The broker
+// drops the expiration when it dead-letters the message back, so the copy
+// keeps no TTL of its own. Messages only expire at the head of the retry
+// queue, so a message can wait longer than delay behind a longer one.
+func retryPublishing(msg amqp.Delivery, retries int, delay time.Duration) amqp.Publishing {
+	publishing := failedPublishing(msg, retries)
+	publishing.Expiration = strconv.FormatInt(delay.Milliseconds(), 10)
+
+	return publishing
+}
+
+func failedPublishing(msg amqp.Delivery, retries int) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[retriesHeader] = int64(retries)
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
+
+// deliveryRetries returns how often msg was already retried, taking the larger
+// of carrot's own header and the broker's x-death counts.
+func deliveryRetries(msg amqp.Delivery) int {
+	retries := headerInt(msg.Headers[retriesHeader])
+
+	deaths, _ := msg.Headers["x-death"].([]interface{})
+	total := 0
+	for _, death := range deaths {
+		if table, ok := death.(amqp.Table); ok {
+			total += headerInt(table["count"])
+		}
+	}
+
+	return max(retries, total)
+}
+
+func headerInt(v any) int {
+	switch v := v.(type) {
+	case int:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint8:
+		return int(v)
+	case uint16:
+		return int(v)
+	case uint32:
+		return int(v)
+	default:
+		return 0
+	}
+}
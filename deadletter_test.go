@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+type fakeAcknowledger struct {
+	acked    []uint64
+	nacked   []uint64
+	rejected []uint64
+	requeued bool
+}
+
+func (f *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	f.acked = append(f.acked, tag)
+	return nil
+}
+
+func (f *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	f.nacked = append(f.nacked, tag)
+	f.requeued = requeue
+	return nil
+}
+
+func (f *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	f.rejected = append(f.rejected, tag)
+	f.requeued = requeue
+	return nil
+}
+
+func TestDeliveryRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  amqp.Table
+		expected int
+	}{
+		{
+			name:     "no headers",
+			headers:  nil,
+			expected: 0,
+		},
+		{
+			name:     "carrot retries header",
+			headers:  amqp.Table{retriesHeader: int64(2)},
+			expected: 2,
+		},
+		{
+			name: "x-death counts",
+			headers: amqp.Table{
+				"x-death": []interface{}{
+					amqp.Table{"count": int64(2), "reason": "rejected"},
+					amqp.Table{"count": int64(1), "reason": "expired"},
+				},
+			},
+			expected: 3,
+		},
+		{
+			name: "larger of both",
+			headers: amqp.Table{
+				retriesHeader: int32(5),
+				"x-death":     []interface{}{amqp.Table{"count": int64(1)}},
+			},
+			expected: 5,
+		},
+		{
+			name:     "unexpected header type",
+			headers:  amqp.Table{retriesHeader: "three"},
+			expected: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retries := deliveryRetries(amqp.Delivery{Headers: tt.headers})
+			if retries != tt.expected {
+				t.Errorf("deliveryRetries() = %d, expected %d", retries, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFailedPublishing(t *testing.T) {
+	ts := time.Date(2023, 10, 15, 14, 30, 45, 0, time.UTC)
+	msg := amqp.Delivery{
+		Headers:       amqp.Table{"source": "edge"},
+		ContentType:   "application/json",
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: "abc",
+		MessageId:     "msg-1",
+		Timestamp:     ts,
+		Body:          []byte(`{"metrics": []}`),
+	}
+
+	publishing := failedPublishing(msg, 2)
+
+	if publishing.Headers[retriesHeader] != int64(2) {
+		t.Errorf("expected %s header 2, got %v", retriesHeader, publishing.Headers[retriesHeader])
+	}
+	if publishing.Headers["source"] != "edge" {
+		t.Errorf("expected original headers to be kept, got %v", publishing.Headers)
+	}
+	if _, ok := msg.Headers[retriesHeader]; ok {
+		t.Error("expected original delivery headers to be left untouched")
+	}
+	if publishing.ContentType != msg.ContentType || publishing.MessageId != msg.MessageId ||
+		publishing.CorrelationId != msg.CorrelationId || publishing.DeliveryMode != msg.DeliveryMode ||
+		!publishing.Timestamp.Equal(ts) {
+		t.Errorf("expected message properties to be copied, got %+v", publishing)
+	}
+	if string(publishing.Body) != string(msg.Body) {
+		t.Errorf("expected body %s, got %s", msg.Body, publishing.Body)
+	}
+	if err := publishing.Headers.Validate(); err != nil {
+		t.Errorf("expected valid headers, got %v", err)
+	}
+}
+
+func TestDeadLetter_WithoutExchangeRejects(t *testing.T) {
+	ack := &fakeAcknowledger{}
+	consumer := &RabbitConsumer{cfg: &Config{}}
+	msg := amqp.Delivery{Acknowledger: ack, DeliveryTag: 7}
+
+	if err := consumer.DeadLetter(msg, StageParse, errors.New("bad json")); err != nil {
+		t.Fatalf("DeadLetter() unexpected error: %v", err)
+	}
+
+	if len(ack.rejected) != 1 || ack.rejected[0] != 7 || ack.requeued {
+		t.Errorf("expected delivery 7 to be rejected without requeue, got %+v", ack)
+	}
+}
+
+func TestRetry_ExhaustedDeadLetters(t *testing.T) {
+	ack := &fakeAcknowledger{}
+	cfg := &Config{}
+	cfg.Rabbit.DeadLetter.MaxRetries = 2
+	consumer := &RabbitConsumer{cfg: cfg}
+	msg := amqp.Delivery{
+		Acknowledger: ack,
+		DeliveryTag:  3,
+		Headers:      amqp.Table{retriesHeader: int64(2)},
+	}
+
+	if err := consumer.Retry(msg, StageWrite, errors.New("influx down")); err != nil {
+		t.Fatalf("Retry() unexpected error: %v", err)
+	}
+
+	if len(ack.rejected) != 1 || ack.rejected[0] != 3 {
+		t.Errorf("expected exhausted delivery to be dead-lettered, got %+v", ack)
+	}
+}
+
+func TestRetryPublishing(t *testing.T) {
+	msg := amqp.Delivery{Body: []byte("payload"), Expiration: "60000", Headers: amqp.Table{"x-custom": "value"}}
+
+	publishing := retryPublishing(msg, 2, 1500*time.Millisecond)
+	if publishing.Expiration != "1500" {
+		t.Errorf("expected the retry delay as expiration, got %q", publishing.Expiration)
+	}
+	if publishing.Headers[retriesHeader] != int64(2) || publishing.Headers["x-custom"] != "value" {
+		t.Errorf("expected retry count and original headers, got %v", publishing.Headers)
+	}
+	if string(publishing.Body) != "payload" {
+		t.Errorf("expected body to be kept, got %q", publishing.Body)
+	}
+}
+
+func TestRabbitConsumer_RetryDelay(t *testing.T) {
+	cfg := &Config{}
+	cfg.Rabbit.DeadLetter.RetryDelay = time.Second
+	cfg.Rabbit.DeadLetter.MaxRetryDelay = 4 * time.Second
+	consumer := &RabbitConsumer{cfg: cfg}
+
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 1, max: time.Second},
+		{attempt: 2, max: 2 * time.Second},
+		{attempt: 5, max: 4 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if delay := consumer.retryDelay(tt.attempt); delay < tt.max/2 || delay > tt.max {
+			t.Errorf("retryDelay(%d) = %v, expected between %v and %v", tt.attempt, delay, tt.max/2, tt.max)
+		}
+	}
+
+	if delay := (&RabbitConsumer{cfg: &Config{}}).retryDelay(1); delay < defaultRetryDelay/2 || delay > defaultRetryDelay {
+		t.Errorf("expected default retry delay, got %v", delay)
+	}
+}
+
+func TestAwaitConfirm(t *testing.T) {
+	confirms := make(chan amqp.Confirmation, 1)
+
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	if err := awaitConfirm(confirms); err != nil {
+		t.Errorf("expected acked publish to be confirmed, got %v", err)
+	}
+
+	confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: false}
+	if err := awaitConfirm(confirms); !errors.Is(err, ErrPublishUnconfirmed) {
+		t.Errorf("expected ErrPublishUnconfirmed for a nacked publish, got %v", err)
+	}
+
+	close(confirms)
+	if err := awaitConfirm(confirms); !errors.Is(err, ErrPublishUnconfirmed) {
+		t.Errorf("expected ErrPublishUnconfirmed once the channel closed, got %v", err)
+	}
+}
+
+func TestDeadLetterPublishing(t *testing.T) {
+	msg := amqp.Delivery{Body: []byte(`{"metrics": []}`)}
+	reason := &ValidationError{Issues: []ValidationIssue{{Path: "metrics", Message: "must contain at least one metric"}}}
+
+	publishing := deadLetterPublishing(msg, StageValidate, reason)
+
+	if publishing.Headers[errorStageHeader] != StageValidate {
+		t.Errorf("expected stage %s, got %v", StageValidate, publishing.Headers[errorStageHeader])
+	}
+	if publishing.Headers[errorHeader] != reason.Error() {
+		t.Errorf("expected error header %q, got %v", reason.Error(), publishing.Headers[errorHeader])
+	}
+
+	issues, ok := publishing.Headers[validationHeader].([]interface{})
+	if !ok || len(issues) != 1 {
+		t.Fatalf("expected one validation issue header, got %v", publishing.Headers[validationHeader])
+	}
+	if issue := issues[0].(amqp.Table); issue["path"] != "metrics" {
+		t.Errorf("expected issue path 'metrics', got %v", issue["path"])
+	}
+	if err := publishing.Headers.Validate(); err != nil {
+		t.Errorf("expected valid headers, got %v", err)
+	}
+
+	plain := deadLetterPublishing(msg, StageParse, errors.New("bad json"))
+	if _, ok := plain.Headers[validationHeader]; ok {
+		t.Error("expected no validation header for non-validation errors")
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"mime"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	FormatJSON     = "json"
+	FormatMsgpack  = "msgpack"
+	FormatCBOR     = "cbor"
+	FormatProtobuf = "protobuf"
+)
+
+var ErrUnsupportedContentType = errors.New("unsupported content type")
+
+// Decoder parses a message body into metrics using the timestamp settings of
+// the source it came from.
+type Decoder func(body []byte, cfg TimeConfig) ([]*Metric, error)
+
+var (
+	decodersMu sync.RWMutex
+	decoders   = map[string]Decoder{}
+	// contentTypeFormats maps the media types producers put on messages to
+	// the format their body is decoded with.
+	contentTypeFormats = map[string]string{}
+)
+
+// genericContentTypes say little about the body, as clients and brokers set
+// them by default, so the configured format of a source wins over them.
+var genericContentTypes = map[string]bool{
+	"text/plain":               true,
+	"application/octet-stream": true,
+}
+
+var cborDecoder, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]any(nil)),
+	IntDec:         cbor.IntDecConvertSigned,
+}.DecMode()
+
+func init() {
+	RegisterDecoder(FormatJSON, ConsumeMessageWith, "application/json")
+	RegisterDecoder(FormatMsgpack, decodeMsgpack, "application/msgpack", "application/x-msgpack", "application/vnd.msgpack")
+	RegisterDecoder(FormatCBOR, decodeCBOR, "application/cbor")
+	RegisterDecoder(FormatProtobuf, decodeProtobuf, "application/protobuf", "application/x-protobuf", "application/vnd.google.protobuf")
+}
+
+// RegisterDecoder makes decoder available under the format name used in source
+// configs, and selects it for messages carrying any of the given content
+// types. Registering a format again replaces its decoder.
+func RegisterDecoder(format string, decoder Decoder, contentTypes ...string) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+
+	decoders[format] = decoder
+	for _, contentType := range contentTypes {
+		contentTypeFormats[strings.ToLower(contentType)] = format
+	}
+}
+
+// DecodeMessage parses body with the decoder registered for its content type.
+// Bodies without a content type, or with a generic one such as text/plain,
+// use the configured format of their source, the JSON envelope by default.
+// Many AMQP clients send JSON as text/plain, so line protocol needs its own
+// content type or format.
+func DecodeMessage(body []byte, contentType string, format string, cfg TimeConfig) ([]*Metric, error) {
+	decoder, err := LookupDecoder(contentType, format)
+	if err != nil {
+		return nil, err
+	}
+
+	return decoder(body, cfg)
+}
+
+// LookupDecoder returns the decoder for contentType, or for format when no
+// content type or only a generic one is given.
+func LookupDecoder(contentType string, format string) (Decoder, error) {
+	decodersMu.RLock()
+	defer decodersMu.RUnlock()
+
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content type %q: %v", contentType, err)
+		}
+
+		known, ok := contentTypeFormats[mediaType]
+		switch {
+		case genericContentTypes[mediaType] && format != "":
+		case ok:
+			format = known
+		case !genericContentTypes[mediaType]:
+			return nil, fmt.Errorf("%w %q, expected one of %v", ErrUnsupportedContentType, mediaType, slices.Sorted(maps.Keys(contentTypeFormats)))
+		}
+	}
+
+	if format == "" {
+		format = FormatJSON
+	}
+
+	decoder, ok := decoders[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported message format %q, expected one of %v", format, slices.Sorted(maps.Keys(decoders)))
+	}
+
+	return decoder, nil
+}
+
+func decodeMsgpack(body []byte, cfg TimeConfig) ([]*Metric, error) {
+	decoder := msgpack.NewDecoder(bytes.NewReader(body))
+	decoder.UseLooseInterfaceDecoding(true)
+
+	var envelope map[string]any
+	if err := decoder.Decode(&envelope); err != nil {
+		return nil, err
+	}
+
+	return consumeEnvelope(envelope, cfg)
+}
+
+func decodeCBOR(body []byte, cfg TimeConfig) ([]*Metric, error) {
+	var envelope map[string]any
+	if err := cborDecoder.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+
+	return consumeEnvelope(envelope, cfg)
+}
+
+// decodeProtobuf reads the envelope as a google.protobuf.Struct. Its numbers
+// are doubles, so epoch timestamps beyond millisecond precision should be
+// sent as strings.
+func decodeProtobuf(body []byte, cfg TimeConfig) ([]*Metric, error) {
+	var envelope structpb.Struct
+	if err := proto.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+
+	return consumeEnvelope(envelope.AsMap(), cfg)
+}
+
+// consumeEnvelope builds metrics from an envelope decoded by a schemaless
+// format, following the same rules as ConsumeMessageWith.
+func consumeEnvelope(envelope map[string]any, cfg TimeConfig) ([]*Metric, error) {
+	if precision, ok := envelope["_precision"]; ok {
+		value, ok := precision.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid _precision: expected string, got %T", precision)
+		}
+		cfg.Precision = value
+	}
+
+	tags, err := stringTags(envelope, true)
+	if err != nil {
+		return nil, err
+	}
+
+	rawMetrics, ok := envelope["metrics"].([]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid metrics array: got %T", envelope["metrics"])
+	}
+
+	var metrics []*Metric
+	for _, item := range rawMetrics {
+		raw, ok := item.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid metric: expected object, got %T", item)
+		}
+
+		name, ok := raw["name"].(string)
+		if !ok && raw["name"] != nil {
+			return nil, fmt.Errorf("invalid metric name: expected string, got %T", raw["name"])
+		}
+
+		var fields map[string]any
+		if raw["fields"] != nil {
+			fields, ok = raw["fields"].(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("invalid fields of metric %s: expected object, got %T", name, raw["fields"])
+			}
+		}
+
+		var metricTags map[string]string
+		if rawTags, ok := raw["tags"].(map[string]any); ok {
+			metricTags, err = stringTags(rawTags, false)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		t, err := ParseTimeWith(raw["time"], cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp: %v", err)
+		}
+
+		metrics = append(metrics, &Metric{
+			Name:      name,
+			Value:     raw["value"],
+			Fields:    fields,
+			Timestamp: t,
+			Tags:      mergeTags(tags, metricTags),
+		})
+	}
+
+	return metrics, nil
+}
+
+// stringTags collects the string values of raw as tags. For the envelope
+// itself the metrics array and underscore-prefixed settings are skipped.
+func stringTags(raw map[string]any, envelope bool) (map[string]string, error) {
+	tags := make(map[string]string)
+	for k, v := range raw {
+		if envelope && (k == "metrics" || strings.HasPrefix(k, "_")) {
+			continue
+		}
+
+		val, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid tag value for key %s: expected string, got %T", k, v)
+		}
+
+		tags[k] = val
+	}
+
+	return tags, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	lineProtocol := []byte("cpu value=1 1697380245000000000")
+	envelope := []byte(metricBody("cpu"))
+
+	tests := []struct {
+		name        string
+		body        []byte
+		contentType string
+		format      string
+		expectError bool
+	}{
+		{name: "json by default", body: envelope},
+		{name: "text/plain without format is json", body: envelope, contentType: "text/plain; charset=utf-8"},
+		{name: "line protocol as text/plain is not json", body: lineProtocol, contentType: "text/plain", expectError: true},
+		{name: "format wins over text/plain for line protocol", body: lineProtocol, contentType: "text/plain", format: FormatLineProtocol},
+		{name: "influx content type", body: lineProtocol, contentType: "application/x-influx-line-protocol"},
+		{name: "content type is case insensitive", body: envelope, contentType: "Application/JSON"},
+		{name: "configured format", body: lineProtocol, format: FormatLineProtocol},
+		{name: "content type wins over format", body: envelope, contentType: "application/json", format: FormatLineProtocol},
+		{name: "unknown content type uses format", body: lineProtocol, contentType: "application/octet-stream", format: FormatLineProtocol},
+		{name: "format wins over text/plain", body: envelope, contentType: "text/plain", format: FormatJSON},
+		{name: "octet-stream without format is json", body: envelope, contentType: "application/octet-stream"},
+		{name: "unknown content type", body: envelope, contentType: "application/xml", expectError: true},
+		{name: "malformed content type", body: envelope, contentType: "json;;", expectError: true},
+		{name: "unsupported format", body: envelope, format: "xml", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics, err := DecodeMessage(tt.body, tt.contentType, tt.format, TimeConfig{})
+			if tt.expectError {
+				if err == nil {
+					t.Error("expected error but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("DecodeMessage() unexpected error: %v", err)
+			}
+			if len(metrics) != 1 || metrics[0].Name != "cpu" {
+				t.Errorf("expected one cpu metric, got %+v", metrics)
+			}
+		})
+	}
+}
+
+func TestDecodeMessage_UnknownContentType(t *testing.T) {
+	_, err := DecodeMessage([]byte("<metrics/>"), "application/xml", "", TimeConfig{})
+	if !errors.Is(err, ErrUnsupportedContentType) {
+		t.Fatalf("expected ErrUnsupportedContentType, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "application/json") {
+		t.Errorf("expected error to list supported content types, got %v", err)
+	}
+}
+
+func TestRegisterDecoder(t *testing.T) {
+	RegisterDecoder("test-single", func(body []byte, cfg TimeConfig) ([]*Metric, error) {
+		return []*Metric{{Name: string(body), Value: 1.0}}, nil
+	}, "application/x-test-single")
+
+	metrics, err := DecodeMessage([]byte("custom"), "application/x-test-single", "", TimeConfig{})
+	if err != nil {
+		t.Fatalf("DecodeMessage() unexpected error: %v", err)
+	}
+	if len(metrics) != 1 || metrics[0].Name != "custom" {
+		t.Errorf("expected metric from registered decoder, got %+v", metrics)
+	}
+
+	if _, err := LookupDecoder("", "test-single"); err != nil {
+		t.Errorf("expected registered format to be usable as default, got %v", err)
+	}
+}
+
+// testEnvelope is the generic form of metricBody with a second metric carrying
+// fields, tags and an epoch timestamp.
+func testEnvelope() map[string]any {
+	return map[string]any{
+		"host":       "server1",
+		"_precision": "ms",
+		"metrics": []any{
+			map[string]any{"name": "cpu_usage", "value": 75.5, "time": "2023-10-15T14:30:45Z"},
+			map[string]any{
+				"name":   "mem",
+				"fields": map[string]any{"used": 60.2, "free": 39.8},
+				"tags":   map[string]any{"host": "server2"},
+				"time":   int64(1697380245000),
+			},
+		},
+	}
+}
+
+func TestDecodeMessage_BinaryFormats(t *testing.T) {
+	msgpackBody, err := msgpack.Marshal(testEnvelope())
+	if err != nil {
+		t.Fatalf("msgpack.Marshal() unexpected error: %v", err)
+	}
+
+	cborBody, err := cbor.Marshal(testEnvelope())
+	if err != nil {
+		t.Fatalf("cbor.Marshal() unexpected error: %v", err)
+	}
+
+	envelope, err := structpb.NewStruct(testEnvelope())
+	if err != nil {
+		t.Fatalf("structpb.NewStruct() unexpected error: %v", err)
+	}
+	protobufBody, err := proto.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("proto.Marshal() unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		body        []byte
+		contentType string
+	}{
+		{name: "msgpack", body: msgpackBody, contentType: "application/msgpack"},
+		{name: "cbor", body: cborBody, contentType: "application/cbor"},
+		{name: "protobuf", body: protobufBody, contentType: "application/x-protobuf"},
+	}
+
+	expectedTime := time.Date(2023, 10, 15, 14, 30, 45, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics, err := DecodeMessage(tt.body, tt.contentType, "", TimeConfig{})
+			if err != nil {
+				t.Fatalf("DecodeMessage() unexpected error: %v", err)
+			}
+			if len(metrics) != 2 {
+				t.Fatalf("expected 2 metrics, got %d", len(metrics))
+			}
+
+			cpu, mem := metrics[0], metrics[1]
+			if cpu.Name != "cpu_usage" || cpu.Value != 75.5 || cpu.Tags["host"] != "server1" {
+				t.Errorf("unexpected first metric %+v", cpu)
+			}
+			if !cpu.Timestamp.Equal(expectedTime) {
+				t.Errorf("expected timestamp %v, got %v", expectedTime, cpu.Timestamp)
+			}
+
+			if !reflect.DeepEqual(mem.Fields, map[string]any{"used": 60.2, "free": 39.8}) {
+				t.Errorf("expected mem fields, got %v", mem.Fields)
+			}
+			if mem.Tags["host"] != "server2" {
+				t.Errorf("expected metric tags to override envelope tags, got %v", mem.Tags)
+			}
+			if !mem.Timestamp.Equal(expectedTime) {
+				t.Errorf("expected epoch timestamp in ms %v, got %v", expectedTime, mem.Timestamp)
+			}
+		})
+	}
+}
+
+func TestDecodeMessage_InvalidEnvelope(t *testing.T) {
+	tests := []struct {
+		name     string
+		envelope map[string]any
+	}{
+		{name: "missing metrics", envelope: map[string]any{"host": "server1"}},
+		{name: "non string tag", envelope: map[string]any{"host": 1, "metrics": []any{}}},
+		{name: "metric not an object", envelope: map[string]any{"metrics": []any{"cpu"}}},
+		{name: "non string precision", envelope: map[string]any{"_precision": 3, "metrics": []any{}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := msgpack.Marshal(tt.envelope)
+			if err != nil {
+				t.Fatalf("msgpack.Marshal() unexpected error: %v", err)
+			}
+
+			if _, err := DecodeMessage(body, "application/msgpack", "", TimeConfig{}); err == nil {
+				t.Error("expected error but got none")
+			}
+		})
+	}
+}
+
+func TestIngestHandler_UnsupportedContentType(t *testing.T) {
+	writeAPI := &fakeWriteAPI{}
+	server := NewApiServer(ApiConfig{}, NewInfluxSink(writeAPI), nil, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/metrics", strings.NewReader(metricBody("cpu")))
+	req.Header.Set("Content-Type", "application/xml")
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status %d, got %d", http.StatusUnsupportedMediaType, rec.Code)
+	}
+	if len(writeAPI.Points()) != 0 {
+		t.Errorf("expected nothing written, got %d points", len(writeAPI.Points()))
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+const defaultMaxDecompressedSize = 64 << 20
+
+var (
+	ErrUnsupportedEncoding  = errors.New("unsupported content encoding")
+	ErrDecompressedTooLarge = errors.New("decompressed body too large")
+)
+
+// snappyStreamMagic starts every body in the snappy framing format, which
+// is told apart from a single snappy block by it.
+var snappyStreamMagic = []byte("\xff\x06\x00\x00sNaPpY")
+
+// Decompress returns body decoded according to its content encoding, refusing
+// to inflate it beyond maxSize bytes (64MiB when unset). Bodies without an
+// encoding are returned as they are.
+func Decompress(body []byte, encoding string, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		maxSize = defaultMaxDecompressedSize
+	}
+
+	var reader io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		defer gz.Close()
+		reader = gz
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd body: %w", err)
+		}
+		defer zr.Close()
+		reader = zr
+	case "snappy":
+		if !bytes.HasPrefix(body, snappyStreamMagic) {
+			return decodeSnappyBlock(body, maxSize)
+		}
+		reader = snappy.NewReader(bytes.NewReader(body))
+	case "lz4":
+		reader = lz4.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("%w %q, expected gzip, zstd, snappy or lz4", ErrUnsupportedEncoding, encoding)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress %s body: %w", encoding, err)
+	}
+
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("%w: exceeds %d bytes", ErrDecompressedTooLarge, maxSize)
+	}
+
+	return data, nil
+}
+
+// decodeSnappyBlock checks the length a snappy block declares up front so an
+// oversized body is refused before anything is allocated for it.
+func decodeSnappyBlock(body []byte, maxSize int64) ([]byte, error) {
+	size, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy body: %w", err)
+	}
+
+	if int64(size) > maxSize {
+		return nil, fmt.Errorf("%w: declares %d bytes, at most %d allowed", ErrDecompressedTooLarge, size, maxSize)
+	}
+
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy body: %w", err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var writer interface {
+		Write([]byte) (int, error)
+		Close() error
+	}
+
+	switch encoding {
+	case "gzip":
+		writer = gzip.NewWriter(&buf)
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatalf("zstd.NewWriter() unexpected error: %v", err)
+		}
+		writer = zw
+	case "snappy":
+		writer = snappy.NewBufferedWriter(&buf)
+	case "snappy-block":
+		return snappy.Encode(nil, data)
+	case "lz4":
+		writer = lz4.NewWriter(&buf)
+	default:
+		t.Fatalf("unknown encoding %s", encoding)
+	}
+
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	data := []byte(strings.Repeat(metricBody("cpu_usage"), 10))
+
+	tests := []struct {
+		name        string
+		encoding    string
+		compression string
+	}{
+		{name: "gzip", encoding: "gzip", compression: "gzip"},
+		{name: "x-gzip", encoding: "x-gzip", compression: "gzip"},
+		{name: "zstd", encoding: "zstd", compression: "zstd"},
+		{name: "snappy framed", encoding: "snappy", compression: "snappy"},
+		{name: "snappy block", encoding: "snappy", compression: "snappy-block"},
+		{name: "lz4", encoding: "lz4", compression: "lz4"},
+		{name: "case insensitive", encoding: " GZIP ", compression: "gzip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Decompress(compress(t, tt.compression, data), tt.encoding, 0)
+			if err != nil {
+				t.Fatalf("Decompress() unexpected error: %v", err)
+			}
+			if !bytes.Equal(result, data) {
+				t.Errorf("expected %d bytes of original body, got %d", len(data), len(result))
+			}
+		})
+	}
+}
+
+func TestDecompress_Identity(t *testing.T) {
+	data := []byte(metricBody("cpu"))
+	for _, encoding := range []string{"", "identity"} {
+		result, err := Decompress(data, encoding, 0)
+		if err != nil || !bytes.Equal(result, data) {
+			t.Errorf("expected %q to pass the body through, got %q, %v", encoding, result, err)
+		}
+	}
+}
+
+func TestDecompress_MaxSize(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 1024)
+
+	for _, compression := range []string{"gzip", "zstd", "snappy", "snappy-block", "lz4"} {
+		t.Run(compression, func(t *testing.T) {
+			encoding, _, _ := strings.Cut(compression, "-")
+			_, err := Decompress(compress(t, compression, data), encoding, 512)
+			if !errors.Is(err, ErrDecompressedTooLarge) {
+				t.Errorf("expected ErrDecompressedTooLarge, got %v", err)
+			}
+
+			if _, err := Decompress(compress(t, compression, data), encoding, 1024); err != nil {
+				t.Errorf("expected body at the limit to be accepted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDecompress_Errors(t *testing.T) {
+	if _, err := Decompress([]byte("body"), "br", 0); !errors.Is(err, ErrUnsupportedEncoding) {
+		t.Errorf("expected ErrUnsupportedEncoding, got %v", err)
+	}
+
+	for _, encoding := range []string{"gzip", "zstd", "snappy", "lz4"} {
+		if _, err := Decompress([]byte("not compressed"), encoding, 0); err == nil {
+			t.Errorf("expected error for invalid %s body", encoding)
+		}
+	}
+}
+
+func TestIngestHandler_Compressed(t *testing.T) {
+	tests := []struct {
+		name           string
+		encoding       string
+		body           []byte
+		maxSize        int64
+		expectedStatus int
+	}{
+		{
+			name:           "gzip body",
+			encoding:       "gzip",
+			body:           compress(t, "gzip", []byte(metricBody("cpu"))),
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "decompressed too large",
+			encoding:       "gzip",
+			body:           compress(t, "gzip", []byte(metricBody("cpu"))),
+			maxSize:        10,
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:           "unsupported encoding",
+			encoding:       "br",
+			body:           []byte(metricBody("cpu")),
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:           "corrupt body",
+			encoding:       "gzip",
+			body:           []byte(metricBody("cpu")),
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeAPI := &fakeWriteAPI{}
+			server := NewApiServer(ApiConfig{MaxDecompressedSize: tt.maxSize}, NewInfluxSink(writeAPI), nil, nil)
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Encoding", tt.encoding)
+			rec := httptest.NewRecorder()
+			server.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d (%s)", tt.expectedStatus, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
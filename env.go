@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the name of every variable that overrides a config field.
+// The rest is the field's YAML path, upper-cased and joined with underscores,
+// so Rabbit.Password is CARROT_RABBIT_PASSWORD and the Token of the second
+// sink is CARROT_SINKS_1_INFLUX_TOKEN.
+const envPrefix = "CARROT"
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// interpolateEnv replaces ${VAR} and ${VAR:-default} in every scalar value of
+// node with the environment. Referencing an unset variable without a default
+// is an error, so a missing secret is caught at startup.
+func interpolateEnv(node *yaml.Node, path string) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for i, child := range node.Content {
+			childPath := path
+			if node.Kind == yaml.SequenceNode {
+				childPath = fmt.Sprintf("%s[%d]", path, i)
+			}
+
+			if err := interpolateEnv(child, childPath); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if err := interpolateEnv(node.Content[i+1], joinPath(path, node.Content[i].Value)); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${") {
+			return nil
+		}
+
+		var missing []string
+		node.Value = envReference.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			match := envReference.FindStringSubmatch(ref)
+			if value, ok := os.LookupEnv(match[1]); ok {
+				return value
+			}
+			if strings.Contains(ref, ":-") {
+				return match[2]
+			}
+
+			missing = append(missing, match[1])
+			return ""
+		})
+
+		if len(missing) > 0 {
+			return fmt.Errorf("%s: environment variable %s is not set", path, strings.Join(missing, ", "))
+		}
+
+		// Let plain scalars resolve again, so ${PORT} still decodes into an int.
+		if node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+			node.Tag = ""
+		}
+	}
+
+	return nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// applyEnv overrides the fields of cfg with the CARROT_ variables that are set.
+func applyEnv(cfg *Config) error {
+	return applyEnvValue(reflect.ValueOf(cfg).Elem(), envPrefix)
+}
+
+func applyEnvValue(v reflect.Value, name string) error {
+	switch {
+	case v.Kind() == reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			key, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+			if key == "" || key == "-" {
+				continue
+			}
+
+			if err := applyEnvValue(v.Field(i), name+"_"+strings.ToUpper(key)); err != nil {
+				return err
+			}
+		}
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		// Entries past the end of the file's list are added when any of
+		// their fields is set.
+		for i := 0; i < v.Len() || hasEnvPrefix(name+"_"+strconv.Itoa(i)+"_"); i++ {
+			if i == v.Len() {
+				v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			}
+
+			if err := applyEnvValue(v.Index(i), name+"_"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil
+		}
+
+		if err := setEnvValue(v, value); err != nil {
+			return fmt.Errorf("%s: invalid value %q: %w", name, value, err)
+		}
+	}
+
+	return nil
+}
+
+// setEnvValue sets strings verbatim, splits string lists on commas unless
+// written as a YAML flow sequence, and decodes everything else as YAML.
+func setEnvValue(v reflect.Value, value string) error {
+	if v.Kind() == reflect.String {
+		v.SetString(value)
+		return nil
+	}
+
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+
+		v.Set(reflect.ValueOf(items).Convert(v.Type()))
+		return nil
+	}
+
+	decoded := reflect.New(v.Type())
+	if err := yaml.Unmarshal([]byte(value), decoded.Interface()); err != nil {
+		return err
+	}
+
+	v.Set(decoded.Elem())
+	return nil
+}
+
+func hasEnvPrefix(prefix string) bool {
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
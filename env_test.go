@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	return path
+}
+
+func TestReadConfig_Interpolation(t *testing.T) {
+	t.Setenv("INFLUX_TOKEN", "secret-token")
+	t.Setenv("RABBIT_PORT", "5673")
+	t.Setenv("RABBIT_HOST", "rabbit")
+
+	path := writeConfig(t, `
+Influx:
+  token: ${INFLUX_TOKEN}
+  url: "http://${INFLUX_HOST:-localhost}:8086"
+Rabbit:
+  Host: ${RABBIT_HOST}.svc
+  Port: ${RABBIT_PORT}
+  Password: '${RABBIT_PASSWORD:-}'
+`)
+
+	cfg, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig() unexpected error: %v", err)
+	}
+
+	if cfg.InfluxdbConfig.Token != "secret-token" {
+		t.Errorf("expected token from environment, got %q", cfg.InfluxdbConfig.Token)
+	}
+	if cfg.InfluxdbConfig.Url != "http://localhost:8086" {
+		t.Errorf("expected default to be used, got %q", cfg.InfluxdbConfig.Url)
+	}
+	if cfg.Rabbit.Host != "rabbit.svc" {
+		t.Errorf("expected interpolation inside a value, got %q", cfg.Rabbit.Host)
+	}
+	if cfg.Rabbit.Port != 5673 {
+		t.Errorf("expected interpolated port 5673, got %d", cfg.Rabbit.Port)
+	}
+	if cfg.Rabbit.Password != "" {
+		t.Errorf("expected empty default, got %q", cfg.Rabbit.Password)
+	}
+}
+
+func TestReadConfig_InterpolationMissingVariable(t *testing.T) {
+	path := writeConfig(t, `
+Rabbit:
+  Password: ${CARROT_TEST_UNSET_PASSWORD}
+`)
+
+	_, err := ReadConfig(path)
+	if err == nil {
+		t.Fatal("expected error but got none")
+	}
+	if !strings.Contains(err.Error(), "Rabbit.Password") || !strings.Contains(err.Error(), "CARROT_TEST_UNSET_PASSWORD") {
+		t.Errorf("expected error to name the field and variable, got %v", err)
+	}
+}
+
+func TestReadConfig_EnvOverrides(t *testing.T) {
+	t.Setenv("CARROT_INFLUX_TOKEN", "env-token")
+	t.Setenv("CARROT_INFLUX_BATCH_FLUSHINTERVAL", "5s")
+	t.Setenv("CARROT_RABBIT_HOST", "rabbit.svc")
+	t.Setenv("CARROT_RABBIT_PASSWORD", "p#ss: word")
+	t.Setenv("CARROT_RABBIT_PORT", "5673")
+	t.Setenv("CARROT_RABBIT_QUEUE_DURABLE", "true")
+	t.Setenv("CARROT_RABBIT_QUEUE_ARGUMENTS", "{x-max-priority: 10}")
+	t.Setenv("CARROT_KAFKA_BROKERS", "kafka-1:9092, kafka-2:9092")
+	t.Setenv("CARROT_API_TIME_LAYOUTS", `["Jan 2, 2006"]`)
+	t.Setenv("CARROT_SHUTDOWNTIMEOUT", "1m")
+	t.Setenv("CARROT_SINKS_0_INFLUX_TOKEN", "eu-token")
+	t.Setenv("CARROT_SINKS_1_NAME", "audit")
+	t.Setenv("CARROT_SINKS_1_TYPE", SinkFile)
+
+	path := writeConfig(t, `
+Influx:
+  token: file-token
+Rabbit:
+  Host: localhost
+  Port: 5672
+Sinks:
+  - Name: eu
+    Influx:
+      token: file-token
+`)
+
+	cfg, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig() unexpected error: %v", err)
+	}
+
+	if cfg.InfluxdbConfig.Token != "env-token" {
+		t.Errorf("expected env token to win over file, got %q", cfg.InfluxdbConfig.Token)
+	}
+	if cfg.InfluxdbConfig.Batch.FlushInterval != 5*time.Second {
+		t.Errorf("expected flush interval 5s, got %v", cfg.InfluxdbConfig.Batch.FlushInterval)
+	}
+	if cfg.Rabbit.Host != "rabbit.svc" || cfg.Rabbit.Port != 5673 {
+		t.Errorf("expected rabbit.svc:5673, got %s:%d", cfg.Rabbit.Host, cfg.Rabbit.Port)
+	}
+	if cfg.Rabbit.Password != "p#ss: word" {
+		t.Errorf("expected password verbatim, got %q", cfg.Rabbit.Password)
+	}
+	if !cfg.Rabbit.Queue.Durable {
+		t.Error("expected durable queue")
+	}
+	if cfg.Rabbit.Queue.Arguments["x-max-priority"] != 10 {
+		t.Errorf("expected queue arguments from yaml, got %v", cfg.Rabbit.Queue.Arguments)
+	}
+	if !reflect.DeepEqual(cfg.Kafka.Brokers, []string{"kafka-1:9092", "kafka-2:9092"}) {
+		t.Errorf("expected comma separated brokers, got %v", cfg.Kafka.Brokers)
+	}
+	if !reflect.DeepEqual(cfg.Api.Time.Layouts, []string{"Jan 2, 2006"}) {
+		t.Errorf("expected flow sequence layouts, got %v", cfg.Api.Time.Layouts)
+	}
+	if cfg.ShutdownTimeout != time.Minute {
+		t.Errorf("expected shutdown timeout 1m, got %v", cfg.ShutdownTimeout)
+	}
+
+	if len(cfg.Sinks) != 2 {
+		t.Fatalf("expected env to add a second sink, got %+v", cfg.Sinks)
+	}
+	if cfg.Sinks[0].Name != "eu" || cfg.Sinks[0].Influx.Token != "eu-token" {
+		t.Errorf("expected eu sink token from env, got %+v", cfg.Sinks[0])
+	}
+	if cfg.Sinks[1].Name != "audit" || cfg.Sinks[1].Type != SinkFile {
+		t.Errorf("expected audit file sink, got %+v", cfg.Sinks[1])
+	}
+}
+
+func TestReadConfig_InvalidEnvOverride(t *testing.T) {
+	t.Setenv("CARROT_RABBIT_PORT", "not-a-number")
+
+	_, err := ReadConfig(writeConfig(t, "Rabbit:\n  Host: localhost\n"))
+	if err == nil {
+		t.Fatal("expected error but got none")
+	}
+	if !strings.Contains(err.Error(), "CARROT_RABBIT_PORT") {
+		t.Errorf("expected error to name the variable, got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	lp "github.com/influxdata/line-protocol"
+)
+
+// FileSink appends points as line protocol to a local file.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func OpenFileSink(cfg FileSinkConfig) (*FileSink, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("file sink needs a path")
+	}
+
+	file, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{file: file}, nil
+}
+
+func (s *FileSink) Write(ctx context.Context, points []*write.Point) error {
+	data, err := encodePoints(points)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.file.Write(data)
+	return err
+}
+
+func (s *FileSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Sync()
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
+
+// encodePoints returns the line protocol of points, one line each.
+func encodePoints(points []*write.Point) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := lp.NewEncoder(&buf)
+	encoder.SetFieldTypeSupport(lp.UintSupport)
+	encoder.FailOnFieldErr(true)
+	for _, point := range points {
+		if _, err := encoder.Encode(point); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
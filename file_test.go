@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSink_AppendsLineProtocol(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.lp")
+	sink, err := OpenFileSink(FileSinkConfig{Path: path})
+	if err != nil {
+		t.Fatalf("OpenFileSink() unexpected error: %v", err)
+	}
+
+	metrics := []*Metric{
+		{Name: "cpu", Value: 0.5, Tags: map[string]string{"host": "a"}, Timestamp: time.Unix(1, 0)},
+		{Name: "mem", Fields: map[string]any{"used": int64(3)}, Timestamp: time.Unix(2, 0)},
+	}
+	if err := sink.Write(context.Background(), NewPoints(metrics)); err != nil {
+		t.Fatalf("Write() unexpected error: %v", err)
+	}
+	if err := sink.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() unexpected error: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() unexpected error: %v", err)
+	}
+
+	expected := "cpu,host=a cpu=0.5 1000000000\nmem used=3i 2000000000\n"
+	if string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, string(data))
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	healthCheckTimeout = 5 * time.Second
+
+	HealthOK   = "ok"
+	HealthFail = "fail"
+)
+
+// HealthCheck reports whether one dependency, like the broker connection of
+// a source or the InfluxDB server behind a sink, is usable right now.
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// HealthReporter is implemented by sources and sinks whose dependencies
+// decide whether carrot is ready to take traffic.
+type HealthReporter interface {
+	HealthChecks() []HealthCheck
+}
+
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Health runs the checks behind the readiness and startup probes. Startup
+// only needs every check to have passed once, readiness needs all of them to
+// pass on each probe.
+type Health struct {
+	checks []HealthCheck
+
+	mu     sync.Mutex
+	passed map[string]bool
+}
+
+func NewHealth() *Health {
+	return &Health{passed: make(map[string]bool)}
+}
+
+// Add registers the checks of v if it is a HealthReporter.
+func (h *Health) Add(v any) {
+	if reporter, ok := v.(HealthReporter); ok {
+		h.checks = append(h.checks, reporter.HealthChecks()...)
+	}
+}
+
+func (h *Health) Ready(ctx context.Context) HealthReport {
+	return h.run(ctx, h.checks)
+}
+
+// Started reports whether every check has passed at least once, running only
+// those that have not yet.
+func (h *Health) Started(ctx context.Context) HealthReport {
+	h.mu.Lock()
+	var pending []HealthCheck
+	for _, check := range h.checks {
+		if !h.passed[check.Name] {
+			pending = append(pending, check)
+		}
+	}
+	h.mu.Unlock()
+
+	report := h.run(ctx, pending)
+	for _, check := range h.checks {
+		if _, ok := report.Checks[check.Name]; !ok {
+			report.Checks[check.Name] = CheckResult{Status: HealthOK}
+		}
+	}
+
+	return report
+}
+
+// run executes checks concurrently, each bounded by healthCheckTimeout.
+func (h *Health) run(ctx context.Context, checks []HealthCheck) HealthReport {
+	results := make([]CheckResult, len(checks))
+
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+
+			results[i] = CheckResult{Status: HealthOK}
+			if err := check.Check(checkCtx); err != nil {
+				results[i] = CheckResult{Status: HealthFail, Error: err.Error()}
+			}
+		}()
+	}
+	wg.Wait()
+
+	report := HealthReport{Status: HealthOK, Checks: make(map[string]CheckResult, len(checks))}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, check := range checks {
+		report.Checks[check.Name] = results[i]
+		if results[i].Status == HealthOK {
+			h.passed[check.Name] = true
+		} else {
+			report.Status = HealthFail
+		}
+	}
+
+	return report
+}
+
+// Register adds /healthz, /readyz and /startupz to mux. /healthz only tells
+// the process is serving requests.
+func (h *Health) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, HealthReport{Status: HealthOK})
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, h.Ready(r.Context()))
+	})
+	mux.HandleFunc("GET /startupz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, h.Started(r.Context()))
+	})
+}
+
+func writeHealth(w http.ResponseWriter, report HealthReport) {
+	status := http.StatusOK
+	if report.Status != HealthOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
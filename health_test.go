@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// fakeDependency is a HealthReporter whose state can be flipped by tests.
+type fakeDependency struct {
+	name string
+	mu   sync.Mutex
+	err  error
+}
+
+func (f *fakeDependency) SetErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.err = err
+}
+
+func (f *fakeDependency) HealthChecks() []HealthCheck {
+	return []HealthCheck{{Name: f.name, Check: func(ctx context.Context) error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		return f.err
+	}}}
+}
+
+func TestHealth_Ready(t *testing.T) {
+	rabbit := &fakeDependency{name: "rabbit"}
+	influx := &fakeDependency{name: "influx", err: errors.New("connection refused")}
+
+	health := NewHealth()
+	health.Add(rabbit)
+	health.Add(influx)
+	health.Add(NewMemorySource(0))
+
+	report := health.Ready(context.Background())
+	if report.Status != HealthFail {
+		t.Errorf("expected status %s, got %s", HealthFail, report.Status)
+	}
+	if len(report.Checks) != 2 {
+		t.Fatalf("expected only reporters to be checked, got %+v", report.Checks)
+	}
+	if report.Checks["rabbit"].Status != HealthOK {
+		t.Errorf("expected rabbit ok, got %+v", report.Checks["rabbit"])
+	}
+	if check := report.Checks["influx"]; check.Status != HealthFail || check.Error != "connection refused" {
+		t.Errorf("expected influx failure with its error, got %+v", check)
+	}
+
+	influx.SetErr(nil)
+	if report := health.Ready(context.Background()); report.Status != HealthOK {
+		t.Errorf("expected ready once influx recovered, got %+v", report)
+	}
+}
+
+func TestHealth_Started(t *testing.T) {
+	rabbit := &fakeDependency{name: "rabbit"}
+	influx := &fakeDependency{name: "influx", err: errors.New("connection refused")}
+
+	health := NewHealth()
+	health.Add(rabbit)
+	health.Add(influx)
+
+	if report := health.Started(context.Background()); report.Status != HealthFail {
+		t.Fatalf("expected startup to wait for influx, got %+v", report)
+	}
+
+	influx.SetErr(nil)
+	if report := health.Started(context.Background()); report.Status != HealthOK {
+		t.Fatalf("expected started once both connected, got %+v", report)
+	}
+
+	rabbit.SetErr(errors.New("channel closed"))
+	report := health.Started(context.Background())
+	if report.Status != HealthOK || report.Checks["rabbit"].Status != HealthOK {
+		t.Errorf("expected startup to stay complete after a later failure, got %+v", report)
+	}
+	if report := health.Ready(context.Background()); report.Status != HealthFail {
+		t.Errorf("expected readiness to reflect the later failure, got %+v", report)
+	}
+}
+
+func TestHealth_CheckTimeout(t *testing.T) {
+	health := NewHealth()
+	health.Add(&blockingDependency{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if report := health.Ready(ctx); report.Checks["slow"].Status != HealthFail {
+		t.Errorf("expected slow check to fail once the probe gave up, got %+v", report)
+	}
+}
+
+type blockingDependency struct{}
+
+func (blockingDependency) HealthChecks() []HealthCheck {
+	return []HealthCheck{{Name: "slow", Check: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}}
+}
+
+func TestHealth_Endpoints(t *testing.T) {
+	influx := &fakeDependency{name: "influx", err: errors.New("connection refused")}
+	health := NewHealth()
+	health.Add(influx)
+
+	server := NewAdminServer(AdminConfig{}, health)
+
+	tests := []struct {
+		path           string
+		expectedStatus int
+		expectedReport string
+	}{
+		{path: "/healthz", expectedStatus: http.StatusOK, expectedReport: HealthOK},
+		{path: "/readyz", expectedStatus: http.StatusServiceUnavailable, expectedReport: HealthFail},
+		{path: "/startupz", expectedStatus: http.StatusServiceUnavailable, expectedReport: HealthFail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, rec.Code)
+			}
+
+			var report HealthReport
+			if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if report.Status != tt.expectedReport {
+				t.Errorf("expected status %s, got %+v", tt.expectedReport, report)
+			}
+		})
+	}
+
+	api := NewApiServer(ApiConfig{}, NewInfluxSink(&fakeWriteAPI{}), nil, health)
+	rec := httptest.NewRecorder()
+	api.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected api listener to serve /readyz, got status %d", rec.Code)
+	}
+}
+
+// reportingSink is a Sink that also reports the health of its dependency.
+type reportingSink struct {
+	fakeSink
+	fakeDependency
+}
+
+func TestMultiSink_HealthChecks(t *testing.T) {
+	primary := &reportingSink{fakeDependency: fakeDependency{name: ""}}
+	archive := &reportingSink{fakeDependency: fakeDependency{name: "", err: errors.New("down")}}
+
+	multi := NewMultiSink()
+	multi.Add("primary", primary, true)
+	multi.Add("archive", archive, false)
+	multi.Add("file", &fakeSink{}, true)
+
+	checks := multi.HealthChecks()
+	if len(checks) != 1 || checks[0].Name != "primary" {
+		t.Fatalf("expected only the required reporting sink to be checked, got %+v", checks)
+	}
+}
+
+func TestInfluxSink_HealthChecks(t *testing.T) {
+	if checks := NewInfluxSink(&fakeWriteAPI{}).HealthChecks(); len(checks) != 0 {
+		t.Errorf("expected no checks without a client, got %+v", checks)
+	}
+
+	wal, err := OpenWAL(WalConfig{Dir: t.TempDir(), MaxSize: 100})
+	if err != nil {
+		t.Fatalf("OpenWAL() unexpected error: %v", err)
+	}
+	defer wal.Close()
+
+	sink := &InfluxSink{
+		writeAPI: &fakeWriteAPI{},
+		wal:      wal,
+		health:   func(ctx context.Context) error { return nil },
+	}
+
+	multi := NewMultiSink()
+	multi.Add(SinkInflux, sink, true)
+	checks := multi.HealthChecks()
+	if len(checks) != 2 || checks[0].Name != "influx" || checks[1].Name != "influx/wal" {
+		t.Fatalf("expected influx and influx/wal checks, got %+v", checks)
+	}
+
+	if err := checks[1].Check(context.Background()); err != nil {
+		t.Errorf("expected empty wal to pass, got %v", err)
+	}
+
+	points := []*write.Point{write.NewPoint("cpu", nil, map[string]any{"value": 1.0}, time.Now())}
+	for !wal.Full() {
+		if err := wal.Append(points); err != nil {
+			break
+		}
+	}
+	if err := checks[1].Check(context.Background()); err == nil {
+		t.Error("expected full wal to fail its check")
+	}
+}
+
+func TestSources_HealthChecksWithoutConnection(t *testing.T) {
+	mqttSource, _ := newTestMqttSource(t, MqttConfig{})
+	natsSource, _ := newTestNatsSource(t, NatsConfig{})
+
+	for _, reporter := range []HealthReporter{mqttSource, natsSource} {
+		for _, check := range reporter.HealthChecks() {
+			if err := check.Check(context.Background()); err == nil {
+				t.Errorf("expected %s check to fail without a connection", check.Name)
+			}
+		}
+	}
+}
@@ -2,25 +2,161 @@ package main
 
 import (
 	"context"
-	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"errors"
+	"fmt"
+
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
 )
 
-func SendMetric(writeAPI api.WriteAPIBlocking, metrics []*Metric) error {
-	var points []*write.Point	
+// InfluxSink writes points through an InfluxDB write API. Opened from config
+// it retries behind a circuit breaker and spills into a WAL when one is set.
+type InfluxSink struct {
+	writeAPI api.WriteAPIBlocking
+	breaker  *CircuitBreaker
+	wal      *WAL
+	health   func(ctx context.Context) error
+	close    func() error
+}
+
+func NewInfluxSink(writeAPI api.WriteAPIBlocking) *InfluxSink {
+	return &InfluxSink{writeAPI: writeAPI}
+}
+
+func OpenInfluxSink(name string, cfg InfluxdbConfig, walCfg WalConfig) (*InfluxSink, error) {
+	client := influxdb2.NewClient(cfg.Url, cfg.Token)
+	breaker := NewCircuitBreaker(name, cfg.CircuitBreaker)
+	resilientAPI := NewResilientWriteAPI(
+		client.WriteAPIBlocking(cfg.Org, cfg.Bucket),
+		cfg.Retry,
+		breaker,
+	)
+
+	sink := &InfluxSink{
+		writeAPI: resilientAPI,
+		breaker:  breaker,
+		health: func(ctx context.Context) error {
+			return checkInfluxHealth(ctx, client)
+		},
+		close: func() error {
+			client.Close()
+			return nil
+		},
+	}
+
+	if walCfg.Dir == "" {
+		return sink, nil
+	}
+
+	wal, err := OpenWAL(walCfg)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	replayCtx, stopReplay := context.WithCancel(context.Background())
+	replayed := make(chan struct{})
+	go func() {
+		defer close(replayed)
+		wal.RunReplayer(replayCtx, resilientAPI, walCfg.ReplayInterval)
+	}()
+
+	sink.writeAPI = NewSpillingWriteAPI(resilientAPI, wal)
+	sink.wal = wal
+	sink.close = func() error {
+		stopReplay()
+		<-replayed
+		client.Close()
+		return wal.Close()
+	}
+
+	Log.Info("Spilling failed writes to wal", "dir", walCfg.Dir, "bytes", wal.Size())
+	return sink, nil
+}
+
+func (s *InfluxSink) Write(ctx context.Context, points []*write.Point) error {
+	return s.writeAPI.WritePoint(ctx, points...)
+}
+
+func (s *InfluxSink) Flush(ctx context.Context) error {
+	return s.writeAPI.Flush(ctx)
+}
+
+// Wait blocks while the circuit breaker is open, unless the WAL still has
+// room to take the writes instead.
+func (s *InfluxSink) Wait(ctx context.Context) error {
+	if s.breaker == nil || (s.wal != nil && !s.wal.Full()) {
+		return nil
+	}
+
+	return s.breaker.Wait(ctx)
+}
+
+// HealthChecks pings the /health endpoint of InfluxDB and, with a WAL, checks
+// it still has room to spill writes into. The InfluxDB check is unnamed so it
+// goes by the name of the sink.
+func (s *InfluxSink) HealthChecks() []HealthCheck {
+	var checks []HealthCheck
+	if s.health != nil {
+		checks = append(checks, HealthCheck{Check: s.health})
+	}
+
+	if s.wal != nil {
+		checks = append(checks, HealthCheck{Name: "wal", Check: func(ctx context.Context) error {
+			if s.wal.Full() {
+				return fmt.Errorf("wal is full at %d bytes", s.wal.Size())
+			}
+			return nil
+		}})
+	}
+
+	return checks
+}
+
+func checkInfluxHealth(ctx context.Context, client influxdb2.Client) error {
+	health, err := client.Health(ctx)
+	if err != nil {
+		return err
+	}
+
+	if health.Status != domain.HealthCheckStatusPass {
+		message := "unknown reason"
+		if health.Message != nil {
+			message = *health.Message
+		}
+		return errors.New("influxdb is unhealthy: " + message)
+	}
+
+	return nil
+}
+
+func (s *InfluxSink) Close() error {
+	if s.close == nil {
+		return nil
+	}
+
+	return s.close()
+}
+
+func SendMetric(sink Sink, metrics []*Metric) error {
+	return sink.Write(context.Background(), NewPoints(metrics))
+}
+
+func NewPoints(metrics []*Metric) []*write.Point {
+	var points []*write.Point
 
 	for _, metric := range metrics {
 		point := influxdb2.NewPoint(
 			metric.Name,
 			metric.Tags,
-			map[string]interface{}{metric.Name: metric.Value},
+			metric.FieldMap(),
 			metric.Timestamp,
 		)
 
 		points = append(points, point)
 	}
 
-	return writeAPI.WritePoint(context.Background(), points...)
+	return points
 }
-
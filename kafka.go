@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const defaultKafkaGroupID = "carrot"
+
+type kafkaReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+type kafkaPartition struct {
+	topic     string
+	partition int
+}
+
+// kafkaOffsets tracks the fetched messages of one partition that were not
+// committed yet. Offsets only ever get committed up to the first message that
+// is still being processed.
+type kafkaOffsets struct {
+	pending []kafka.Message
+	settled map[int64]bool
+}
+
+// KafkaSource consumes topics as part of a consumer group. Offsets are
+// committed once every message up to them has been written or dead-lettered,
+// so nothing is lost when carrot stops in between.
+type KafkaSource struct {
+	cfg    KafkaConfig
+	reader kafkaReader
+	writer kafkaWriter
+
+	// MessageLog writes the lines about single messages.
+	MessageLog *MessageLog
+
+	messages   chan *Message
+	ctx        context.Context
+	cancel     context.CancelFunc
+	cancelOnce sync.Once
+	fetched    chan struct{}
+
+	mu      sync.Mutex
+	offsets map[kafkaPartition]*kafkaOffsets
+}
+
+func ConsumeKafka(cfg KafkaConfig) (*KafkaSource, error) {
+	if len(cfg.Topics) == 0 {
+		return nil, errors.New("kafka source needs at least one topic")
+	}
+
+	startOffset, err := kafkaStartOffset(cfg.StartOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	groupID := cfg.GroupID
+	if groupID == "" {
+		groupID = defaultKafkaGroupID
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     cfg.Brokers,
+		GroupID:     groupID,
+		GroupTopics: cfg.Topics,
+		StartOffset: startOffset,
+	})
+
+	writer := &kafka.Writer{
+		Addr:     kafka.TCP(cfg.Brokers...),
+		Balancer: &kafka.Hash{},
+	}
+
+	return newKafkaSource(cfg, reader, writer), nil
+}
+
+func newKafkaSource(cfg KafkaConfig, reader kafkaReader, writer kafkaWriter) *KafkaSource {
+	ctx, cancel := context.WithCancel(context.Background())
+	source := &KafkaSource{
+		cfg:      cfg,
+		reader:   reader,
+		writer:   writer,
+		messages: make(chan *Message),
+		ctx:      ctx,
+		cancel:   cancel,
+		fetched:  make(chan struct{}),
+		offsets:  make(map[kafkaPartition]*kafkaOffsets),
+	}
+
+	go source.fetch()
+
+	return source
+}
+
+func (s *KafkaSource) Messages() <-chan *Message {
+	return s.messages
+}
+
+// HealthChecks dials the brokers, as the consumer group reader retries broker
+// errors internally instead of returning them from FetchMessage.
+func (s *KafkaSource) HealthChecks() []HealthCheck {
+	if len(s.cfg.Brokers) == 0 {
+		return nil
+	}
+
+	return []HealthCheck{{Name: SourceKafka, Check: s.checkBrokers}}
+}
+
+// checkBrokers passes once any broker accepts a connection.
+func (s *KafkaSource) checkBrokers(ctx context.Context) error {
+	var dialer net.Dialer
+	var errs []error
+	for _, broker := range s.cfg.Brokers {
+		conn, err := dialer.DialContext(ctx, "tcp", broker)
+		if err == nil {
+			return conn.Close()
+		}
+		errs = append(errs, err)
+	}
+
+	return fmt.Errorf("no kafka broker reachable: %w", errors.Join(errs...))
+}
+
+func (s *KafkaSource) Cancel() error {
+	s.cancelOnce.Do(s.cancel)
+	return nil
+}
+
+func (s *KafkaSource) Close() error {
+	s.Cancel()
+	<-s.fetched
+
+	return errors.Join(s.reader.Close(), s.writer.Close())
+}
+
+func (s *KafkaSource) fetch() {
+	defer close(s.fetched)
+	defer close(s.messages)
+
+	for attempt := 1; ; {
+		msg, err := s.reader.FetchMessage(s.ctx)
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			delay := backoffDelay(defaultReconnectDelay, defaultMaxReconnectDelay, attempt)
+			Log.Warn("Cannot fetch kafka message, retrying", "attempt", attempt, "delay", delay, "err", err)
+			attempt++
+
+			select {
+			case <-time.After(delay):
+			case <-s.ctx.Done():
+				return
+			}
+			continue
+		}
+		attempt = 1
+
+		s.track(msg)
+		select {
+		case s.messages <- s.message(msg):
+		case <-s.ctx.Done():
+			// Never handed out, so it stays uncommitted for the next run.
+			return
+		}
+	}
+}
+
+func (s *KafkaSource) message(msg kafka.Message) *Message {
+	headers := make(map[string]any, len(msg.Headers))
+	for _, header := range msg.Headers {
+		headers[header.Key] = string(header.Value)
+	}
+
+	contentType, _ := headers["content-type"].(string)
+	contentEncoding, _ := headers["content-encoding"].(string)
+
+	m := &Message{
+		Body:            msg.Value,
+		ContentType:     contentType,
+		ContentEncoding: contentEncoding,
+		Headers:         headers,
+		MessageID:       fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset),
+		Timestamp:       msg.Time,
+		Raw:             msg,
+	}
+	m.Ack = func() error {
+		return s.settle(msg)
+	}
+	m.Nack = func(stage string, reason error, retry bool) error {
+		if retry {
+			return s.Retry(m, stage, reason)
+		}
+		return s.DeadLetter(m, stage, reason)
+	}
+
+	return m
+}
+
+// AckBatch settles msgs and commits each partition once.
+func (s *KafkaSource) AckBatch(msgs []*Message) error {
+	kafkaMsgs := make([]kafka.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if kafkaMsg, ok := msg.Raw.(kafka.Message); ok {
+			kafkaMsgs = append(kafkaMsgs, kafkaMsg)
+		}
+	}
+
+	return s.settle(kafkaMsgs...)
+}
+
+// Retry produces a copy of m back to its topic with an incremented retry
+// count, dead-lettering it instead once MaxRetries is exhausted.
+func (s *KafkaSource) Retry(m *Message, stage string, reason error) error {
+	msg := m.Raw.(kafka.Message)
+	retries := kafkaRetries(msg)
+	if retries >= s.maxRetries() {
+		return s.DeadLetter(m, stage, reason)
+	}
+
+	return s.republish(msg, failedKafkaMessage(msg, msg.Topic, retries+1))
+}
+
+// DeadLetter produces m to DeadLetterTopic with the failure reason in its
+// headers. Without a dead-letter topic the message is dropped.
+func (s *KafkaSource) DeadLetter(m *Message, stage string, reason error) error {
+	msg := m.Raw.(kafka.Message)
+	if s.cfg.DeadLetterTopic == "" {
+		s.MessageLog.For(m).Warn("Dropping kafka message", "topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset, "stage", stage, "err", reason)
+		return s.settle(msg)
+	}
+
+	return s.republish(msg, deadLetterKafkaMessage(msg, s.cfg.DeadLetterTopic, stage, reason))
+}
+
+// republish settles msg once its copy has been produced. If that fails msg
+// stays uncommitted, so it is consumed again after a restart or rebalance.
+func (s *KafkaSource) republish(msg kafka.Message, failed kafka.Message) error {
+	if err := s.writer.WriteMessages(context.Background(), failed); err != nil {
+		return err
+	}
+
+	return s.settle(msg)
+}
+
+func (s *KafkaSource) maxRetries() int {
+	if s.cfg.MaxRetries <= 0 {
+		return defaultMaxRetries
+	}
+
+	return s.cfg.MaxRetries
+}
+
+func (s *KafkaSource) track(msg kafka.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := kafkaPartition{topic: msg.Topic, partition: msg.Partition}
+	offsets, ok := s.offsets[key]
+
+	// Offsets going backwards mean the partition was reassigned and is read
+	// again from its last commit, so earlier bookkeeping is void.
+	if !ok || (len(offsets.pending) > 0 && msg.Offset <= offsets.pending[len(offsets.pending)-1].Offset) {
+		offsets = &kafkaOffsets{settled: make(map[int64]bool)}
+		s.offsets[key] = offsets
+	}
+
+	offsets.pending = append(offsets.pending, msg)
+}
+
+// settle marks msgs as done and commits every partition up to its first
+// message still in progress.
+func (s *KafkaSource) settle(msgs ...kafka.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var commits []kafka.Message
+	touched := make(map[kafkaPartition]bool)
+	for _, msg := range msgs {
+		key := kafkaPartition{topic: msg.Topic, partition: msg.Partition}
+		if offsets, ok := s.offsets[key]; ok {
+			offsets.settled[msg.Offset] = true
+			touched[key] = true
+		}
+	}
+
+	for key := range touched {
+		offsets := s.offsets[key]
+
+		var last *kafka.Message
+		for len(offsets.pending) > 0 && offsets.settled[offsets.pending[0].Offset] {
+			last = &offsets.pending[0]
+			delete(offsets.settled, last.Offset)
+			offsets.pending = offsets.pending[1:]
+		}
+
+		if last != nil {
+			commits = append(commits, *last)
+		}
+	}
+
+	if len(commits) == 0 {
+		return nil
+	}
+
+	return s.reader.CommitMessages(context.Background(), commits...)
+}
+
+func kafkaStartOffset(offset string) (int64, error) {
+	switch offset {
+	case "", "earliest":
+		return kafka.FirstOffset, nil
+	case "latest":
+		return kafka.LastOffset, nil
+	default:
+		return 0, fmt.Errorf("unsupported kafka start offset: %s", offset)
+	}
+}
+
+func kafkaRetries(msg kafka.Message) int {
+	for _, header := range msg.Headers {
+		if header.Key == retriesHeader {
+			retries, _ := strconv.Atoi(string(header.Value))
+			return retries
+		}
+	}
+
+	return 0
+}
+
+func failedKafkaMessage(msg kafka.Message, topic string, retries int) kafka.Message {
+	headers := make([]kafka.Header, 0, len(msg.Headers)+1)
+	for _, header := range msg.Headers {
+		if header.Key != retriesHeader {
+			headers = append(headers, header)
+		}
+	}
+	headers = append(headers, kafka.Header{Key: retriesHeader, Value: []byte(strconv.Itoa(retries))})
+
+	return kafka.Message{
+		Topic:   topic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+		Time:    msg.Time,
+	}
+}
+
+func deadLetterKafkaMessage(msg kafka.Message, topic string, stage string, reason error) kafka.Message {
+	failed := failedKafkaMessage(msg, topic, kafkaRetries(msg))
+	failed.Headers = append(failed.Headers,
+		kafka.Header{Key: errorHeader, Value: []byte(reason.Error())},
+		kafka.Header{Key: errorStageHeader, Value: []byte(stage)},
+	)
+
+	var validationErr *ValidationError
+	if errors.As(reason, &validationErr) {
+		issues, _ := json.Marshal(validationErr.Issues)
+		failed.Headers = append(failed.Headers, kafka.Header{Key: validationHeader, Value: issues})
+	}
+
+	return failed
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/charmbracelet/log"
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeKafkaReader hands out queued messages and records commits, standing in
+// for a consumer group member.
+type fakeKafkaReader struct {
+	msgs chan kafka.Message
+
+	mu      sync.Mutex
+	commits []kafka.Message
+	closed  bool
+}
+
+func newFakeKafkaReader(msgs ...kafka.Message) *fakeKafkaReader {
+	reader := &fakeKafkaReader{msgs: make(chan kafka.Message, len(msgs))}
+	for _, msg := range msgs {
+		reader.msgs <- msg
+	}
+	return reader
+}
+
+func (f *fakeKafkaReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case msg := <-f.msgs:
+		return msg, nil
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (f *fakeKafkaReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.commits = append(f.commits, msgs...)
+	return nil
+}
+
+func (f *fakeKafkaReader) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	return nil
+}
+
+func (f *fakeKafkaReader) Committed() []int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	offsets := make([]int64, len(f.commits))
+	for i, msg := range f.commits {
+		offsets[i] = msg.Offset
+	}
+	return offsets
+}
+
+type fakeKafkaWriter struct {
+	mu      sync.Mutex
+	written []kafka.Message
+	err     error
+}
+
+func (f *fakeKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+
+	f.written = append(f.written, msgs...)
+	return nil
+}
+
+func (f *fakeKafkaWriter) Close() error {
+	return nil
+}
+
+func kafkaMessage(offset int64, body string) kafka.Message {
+	return kafka.Message{Topic: "metrics", Partition: 0, Offset: offset, Value: []byte(body)}
+}
+
+func kafkaHeader(msg kafka.Message, key string) string {
+	for _, header := range msg.Headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+func receive(t *testing.T, source Source, n int) []*Message {
+	t.Helper()
+
+	msgs := make([]*Message, n)
+	for i := range msgs {
+		msgs[i] = <-source.Messages()
+	}
+	return msgs
+}
+
+func TestKafkaSource_CommitsSettledPrefix(t *testing.T) {
+	reader := newFakeKafkaReader(kafkaMessage(10, "a"), kafkaMessage(11, "b"), kafkaMessage(12, "c"))
+	source := newKafkaSource(KafkaConfig{}, reader, &fakeKafkaWriter{})
+	defer source.Close()
+
+	msgs := receive(t, source, 3)
+	if msgs[0].MessageID != "metrics/0/10" || string(msgs[0].Body) != "a" {
+		t.Errorf("unexpected message %+v", msgs[0])
+	}
+
+	msgs[1].Ack()
+	if committed := reader.Committed(); len(committed) != 0 {
+		t.Fatalf("expected no commit while offset 10 is in progress, got %v", committed)
+	}
+
+	msgs[0].Ack()
+	if committed := reader.Committed(); len(committed) != 1 || committed[0] != 11 {
+		t.Fatalf("expected commit up to offset 11, got %v", committed)
+	}
+
+	source.AckBatch(msgs[2:])
+	if committed := reader.Committed(); len(committed) != 2 || committed[1] != 12 {
+		t.Fatalf("expected commit of offset 12, got %v", committed)
+	}
+}
+
+func TestKafkaSource_Retry(t *testing.T) {
+	reader := newFakeKafkaReader(kafkaMessage(0, "a"))
+	writer := &fakeKafkaWriter{}
+	source := newKafkaSource(KafkaConfig{MaxRetries: 2, DeadLetterTopic: "metrics-dlq"}, reader, writer)
+	defer source.Close()
+
+	msg := receive(t, source, 1)[0]
+	if err := msg.Nack(StageWrite, errors.New("influx down"), true); err != nil {
+		t.Fatalf("Nack() unexpected error: %v", err)
+	}
+
+	if len(writer.written) != 1 || writer.written[0].Topic != "metrics" || kafkaHeader(writer.written[0], retriesHeader) != "1" {
+		t.Fatalf("expected message to be produced back with one retry, got %+v", writer.written)
+	}
+	if committed := reader.Committed(); len(committed) != 1 || committed[0] != 0 {
+		t.Errorf("expected original offset to be committed, got %v", committed)
+	}
+
+	exhausted := writer.written[0]
+	exhausted.Offset = 1
+	reader.msgs <- failedKafkaMessage(exhausted, "metrics", 2)
+	msg = receive(t, source, 1)[0]
+	msg.Nack(StageWrite, errors.New("influx down"), true)
+
+	dead := writer.written[1]
+	if dead.Topic != "metrics-dlq" || kafkaHeader(dead, errorStageHeader) != StageWrite || kafkaHeader(dead, errorHeader) != "influx down" {
+		t.Errorf("expected exhausted message to be dead-lettered, got %+v", dead)
+	}
+}
+
+func TestKafkaSource_FailedRepublishStaysUncommitted(t *testing.T) {
+	reader := newFakeKafkaReader(kafkaMessage(0, "a"))
+	source := newKafkaSource(KafkaConfig{DeadLetterTopic: "metrics-dlq"}, reader, &fakeKafkaWriter{err: errors.New("broker down")})
+	defer source.Close()
+
+	msg := receive(t, source, 1)[0]
+	if err := msg.Nack(StageParse, errors.New("bad json"), false); err == nil {
+		t.Fatal("Nack() expected error, got nil")
+	}
+	if committed := reader.Committed(); len(committed) != 0 {
+		t.Errorf("expected nothing committed, got %v", committed)
+	}
+}
+
+func TestKafkaSource_DropLogCarriesCorrelationID(t *testing.T) {
+	var buf bytes.Buffer
+	previous := Log
+	Log = log.NewWithOptions(&buf, log.Options{Formatter: log.JSONFormatter})
+	defer func() { Log = previous }()
+
+	reader := newFakeKafkaReader(kafkaMessage(3, "a"))
+	source := newKafkaSource(KafkaConfig{}, reader, &fakeKafkaWriter{})
+	defer source.Close()
+
+	msg := receive(t, source, 1)[0]
+	if err := msg.Nack(StageParse, errors.New("bad json"), false); err != nil {
+		t.Fatalf("Nack() unexpected error: %v", err)
+	}
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Failed to decode log line %q: %v", buf.String(), err)
+	}
+	if line[correlationKey] != msg.LogID() {
+		t.Errorf("expected correlation id %s, got %v", msg.LogID(), line[correlationKey])
+	}
+}
+
+func TestKafkaSource_ReassignedPartition(t *testing.T) {
+	reader := newFakeKafkaReader(kafkaMessage(5, "a"), kafkaMessage(6, "b"), kafkaMessage(5, "a"))
+	source := newKafkaSource(KafkaConfig{}, reader, &fakeKafkaWriter{})
+	defer source.Close()
+
+	msgs := receive(t, source, 3)
+	msgs[2].Ack()
+
+	if committed := reader.Committed(); len(committed) != 1 || committed[0] != 5 {
+		t.Errorf("expected re-read offset 5 to be committed, got %v", committed)
+	}
+}
+
+func TestKafkaSource_Pipeline(t *testing.T) {
+	reader := newFakeKafkaReader(
+		kafkaMessage(0, metricBody("cpu")),
+		kafkaMessage(1, `{invalid json`),
+		kafkaMessage(2, metricBody("mem")),
+	)
+	writer := &fakeKafkaWriter{}
+	source := newKafkaSource(KafkaConfig{DeadLetterTopic: "metrics-dlq"}, reader, writer)
+	writeAPI := &fakeWriteAPI{}
+	pipeline := &Pipeline{
+		Source: source,
+		Sink:   NewInfluxSink(writeAPI),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- pipeline.RunContext(ctx)
+	}()
+
+	waitFor(t, func() bool {
+		committed := reader.Committed()
+		return len(committed) > 0 && committed[len(committed)-1] == 2
+	})
+	cancel()
+
+	if err := <-result; err != nil {
+		t.Fatalf("RunContext() returned error: %v", err)
+	}
+	if len(writeAPI.Points()) != 2 {
+		t.Errorf("expected 2 points written, got %d", len(writeAPI.Points()))
+	}
+	if len(writer.written) != 1 || kafkaHeader(writer.written[0], errorStageHeader) != StageParse {
+		t.Errorf("expected invalid message to be dead-lettered, got %+v", writer.written)
+	}
+	if !reader.closed {
+		t.Error("expected reader to be closed")
+	}
+}
+
+func TestKafkaStartOffset(t *testing.T) {
+	if offset, err := kafkaStartOffset(""); err != nil || offset != kafka.FirstOffset {
+		t.Errorf("expected earliest by default, got %d, %v", offset, err)
+	}
+	if offset, err := kafkaStartOffset("latest"); err != nil || offset != kafka.LastOffset {
+		t.Errorf("expected latest, got %d, %v", offset, err)
+	}
+	if _, err := kafkaStartOffset("yesterday"); err == nil {
+		t.Error("expected error for unsupported start offset")
+	}
+}
+
+func TestKafkaSource_HealthChecks(t *testing.T) {
+	if checks := newKafkaSource(KafkaConfig{}, newFakeKafkaReader(), &fakeKafkaWriter{}).HealthChecks(); len(checks) != 0 {
+		t.Errorf("expected no checks without brokers, got %+v", checks)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	down := closed.Addr().String()
+	closed.Close()
+
+	up := newKafkaSource(KafkaConfig{Brokers: []string{down, listener.Addr().String()}}, newFakeKafkaReader(), &fakeKafkaWriter{})
+	defer up.Close()
+	checks := up.HealthChecks()
+	if len(checks) != 1 || checks[0].Name != SourceKafka {
+		t.Fatalf("expected a kafka check, got %+v", checks)
+	}
+	if err := checks[0].Check(context.Background()); err != nil {
+		t.Errorf("expected check to pass with one broker reachable, got %v", err)
+	}
+
+	unreachable := newKafkaSource(KafkaConfig{Brokers: []string{down}}, newFakeKafkaReader(), &fakeKafkaWriter{})
+	defer unreachable.Close()
+	if err := unreachable.HealthChecks()[0].Check(context.Background()); err == nil {
+		t.Error("expected check to fail without a reachable broker")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	protocol "github.com/influxdata/line-protocol"
+)
+
+const FormatLineProtocol = "line-protocol"
+
+func init() {
+	RegisterDecoder(FormatLineProtocol, ParseLineProtocol, "application/x-influx-line-protocol")
+}
+
+// ParseLineProtocol parses InfluxDB line protocol into one metric per line,
+// keeping every tag and field. Timestamps are read in the configured
+// precision, nanoseconds by default as in InfluxDB, and lines without one get
+// the current time.
+func ParseLineProtocol(data []byte, cfg TimeConfig) ([]*Metric, error) {
+	unit := time.Nanosecond
+	if cfg.Precision != "" {
+		var ok bool
+		unit, ok = precisions[cfg.Precision]
+		if !ok {
+			return nil, fmt.Errorf("unsupported timestamp precision: %s", cfg.Precision)
+		}
+	}
+
+	handler := protocol.NewMetricHandler()
+	handler.SetTimePrecision(unit)
+
+	parsed, err := protocol.NewParser(handler).Parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := make([]*Metric, 0, len(parsed))
+	for _, p := range parsed {
+		metric := &Metric{
+			Name:      p.Name(),
+			Fields:    make(map[string]any, len(p.FieldList())),
+			Tags:      make(map[string]string, len(p.TagList())),
+			Timestamp: p.Time(),
+		}
+
+		for _, field := range p.FieldList() {
+			metric.Fields[field.Key] = field.Value
+		}
+
+		for _, tag := range p.TagList() {
+			metric.Tags[tag.Key] = tag.Value
+		}
+
+		metrics = append(metrics, metric)
+	}
+
+	return metrics, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLineProtocol(t *testing.T) {
+	data := []byte("cpu,host=server1,region=eu usage_user=12.5,usage_idle=80i,cores=8u,state=\"ok\",up=true 1697380245000000000\n" +
+		"\n" +
+		"mem,host=server1 used=60.2 1697380246000000000\n")
+
+	metrics, err := ParseLineProtocol(data, TimeConfig{})
+	if err != nil {
+		t.Fatalf("ParseLineProtocol() unexpected error: %v", err)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 metrics, got %d", len(metrics))
+	}
+
+	cpu := metrics[0]
+	if cpu.Name != "cpu" {
+		t.Errorf("expected name cpu, got %s", cpu.Name)
+	}
+	expectedFields := map[string]any{
+		"usage_user": 12.5,
+		"usage_idle": int64(80),
+		"cores":      uint64(8),
+		"state":      "ok",
+		"up":         true,
+	}
+	if !reflect.DeepEqual(cpu.Fields, expectedFields) {
+		t.Errorf("expected fields %v, got %v", expectedFields, cpu.Fields)
+	}
+	expectedTags := map[string]string{"host": "server1", "region": "eu"}
+	if !reflect.DeepEqual(cpu.Tags, expectedTags) {
+		t.Errorf("expected tags %v, got %v", expectedTags, cpu.Tags)
+	}
+	if expected := time.Date(2023, 10, 15, 14, 30, 45, 0, time.UTC); !cpu.Timestamp.Equal(expected) {
+		t.Errorf("expected timestamp %v, got %v", expected, cpu.Timestamp)
+	}
+
+	if metrics[1].Name != "mem" || metrics[1].Fields["used"] != 60.2 {
+		t.Errorf("unexpected second metric %+v", metrics[1])
+	}
+}
+
+func TestParseLineProtocol_Precision(t *testing.T) {
+	metrics, err := ParseLineProtocol([]byte("cpu value=1 1697380245"), TimeConfig{Precision: "s"})
+	if err != nil {
+		t.Fatalf("ParseLineProtocol() unexpected error: %v", err)
+	}
+	if expected := time.Date(2023, 10, 15, 14, 30, 45, 0, time.UTC); !metrics[0].Timestamp.Equal(expected) {
+		t.Errorf("expected timestamp %v, got %v", expected, metrics[0].Timestamp)
+	}
+
+	if _, err := ParseLineProtocol([]byte("cpu value=1"), TimeConfig{Precision: "h"}); err == nil {
+		t.Error("expected error for unsupported precision")
+	}
+}
+
+func TestParseLineProtocol_DefaultsToNow(t *testing.T) {
+	before := time.Now()
+	metrics, err := ParseLineProtocol([]byte("cpu value=1"), TimeConfig{})
+	if err != nil {
+		t.Fatalf("ParseLineProtocol() unexpected error: %v", err)
+	}
+	if metrics[0].Timestamp.Before(before.Add(-time.Second)) || metrics[0].Timestamp.After(time.Now()) {
+		t.Errorf("expected current time, got %v", metrics[0].Timestamp)
+	}
+}
+
+func TestParseLineProtocol_Invalid(t *testing.T) {
+	if _, err := ParseLineProtocol([]byte("cpu,host=server1"), TimeConfig{}); err == nil {
+		t.Error("expected error for line without fields")
+	}
+}
+
+func TestIngestHandler_LineProtocol(t *testing.T) {
+	validator, err := NewValidator(ValidationConfig{Strict: true, AllowedTypes: []string{"number"}})
+	if err != nil {
+		t.Fatalf("NewValidator() unexpected error: %v", err)
+	}
+
+	writeAPI := &fakeWriteAPI{}
+	server := NewApiServer(ApiConfig{}, NewInfluxSink(writeAPI), validator, nil)
+
+	body := "cpu,host=server1 user=12.5,system=3.1 1697380245000000000\nmem,host=server1 used=60.2"
+	req := httptest.NewRequest(http.MethodPost, "/v1/metrics", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-influx-line-protocol")
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d (%s)", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+	if len(writeAPI.Points()) != 2 {
+		t.Errorf("expected 2 points written, got %d", len(writeAPI.Points()))
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/metrics", strings.NewReader(`cpu state="down"`))
+	req.Header.Set("Content-Type", "application/x-influx-line-protocol")
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected string field to fail validation, got status %d", rec.Code)
+	}
+}
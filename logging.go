@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+)
+
+const (
+	LogFormatText   = "text"
+	LogFormatJSON   = "json"
+	LogFormatLogfmt = "logfmt"
+
+	LogBodyOff       = "off"
+	LogBodyTruncated = "truncated"
+	LogBodyFull      = "full"
+
+	defaultLogBodyLimit = 256
+
+	correlationKey = "correlation_id"
+)
+
+var logFormatters = map[string]log.Formatter{
+	LogFormatText:   log.TextFormatter,
+	LogFormatJSON:   log.JSONFormatter,
+	LogFormatLogfmt: log.LogfmtFormatter,
+}
+
+// NewLogger builds the global logger from the Logging section. Text keeps the
+// short console timestamps, json and logfmt use RFC3339 for log shippers.
+func NewLogger(cfg LogConfig) (*log.Logger, error) {
+	level := log.InfoLevel
+	if cfg.Level != "" {
+		var err error
+		level, err = log.ParseLevel(cfg.Level)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	format := cfg.Format
+	if format == "" {
+		format = LogFormatText
+	}
+
+	formatter, ok := logFormatters[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported log format %q, expected %s, %s or %s", format, LogFormatText, LogFormatJSON, LogFormatLogfmt)
+	}
+
+	opts := log.Options{
+		Level:           level,
+		Formatter:       formatter,
+		ReportCaller:    true,
+		ReportTimestamp: true,
+		TimeFormat:      time.RFC3339Nano,
+	}
+
+	if formatter == log.TextFormatter {
+		opts.TimeFormat = time.Kitchen
+		opts.Prefix = "Carrot 🥕 "
+	}
+
+	return log.NewWithOptions(os.Stderr, opts), nil
+}
+
+// MessageLog writes the per-message log lines of a pipeline. Every line
+// carries the correlation id of its message, the body is included as
+// configured, and informational lines are sampled. A nil MessageLog logs
+// truncated bodies without sampling.
+type MessageLog struct {
+	cfg     LogConfig
+	sampler *logSampler
+}
+
+func NewMessageLog(cfg LogConfig) (*MessageLog, error) {
+	switch cfg.Body {
+	case "", LogBodyOff, LogBodyTruncated, LogBodyFull:
+	default:
+		return nil, fmt.Errorf("unsupported body logging %q, expected %s, %s or %s", cfg.Body, LogBodyOff, LogBodyTruncated, LogBodyFull)
+	}
+
+	l := &MessageLog{cfg: cfg}
+	if cfg.Sampling.Initial > 0 {
+		l.sampler = &logSampler{initial: cfg.Sampling.Initial, thereafter: cfg.Sampling.Thereafter}
+	}
+
+	return l, nil
+}
+
+// For returns the logger for lines about msg. Sources without a MessageLog
+// of their own call it on nil.
+func (l *MessageLog) For(msg *Message) *log.Logger {
+	return Log.With(correlationKey, msg.LogID())
+}
+
+// Received logs the arrival of msg, unless sampled out.
+func (l *MessageLog) Received(msg *Message) {
+	if l != nil && !l.sampler.allow() {
+		return
+	}
+
+	// Report the pipeline as the caller rather than this line.
+	logger := l.For(msg)
+	logger.Helper()
+	if body, ok := l.body(msg.Body); ok {
+		logger.Info("Received! ", "body", body)
+		return
+	}
+
+	logger.Info("Received! ", "bytes", len(msg.Body))
+}
+
+func (l *MessageLog) body(body []byte) (string, bool) {
+	mode, limit := LogBodyTruncated, defaultLogBodyLimit
+	if l != nil {
+		if l.cfg.Body != "" {
+			mode = l.cfg.Body
+		}
+		if l.cfg.BodyLimit > 0 {
+			limit = l.cfg.BodyLimit
+		}
+	}
+
+	switch {
+	case mode == LogBodyOff:
+		return "", false
+	case mode == LogBodyTruncated && len(body) > limit:
+		return fmt.Sprintf("%s... (%d bytes)", body[:limit], len(body)), true
+	default:
+		return string(body), true
+	}
+}
+
+// LogID returns the id log lines about m carry: its correlation id, else its
+// message id, else one generated on first use.
+func (m *Message) LogID() string {
+	if m.CorrelationID != "" {
+		return m.CorrelationID
+	}
+
+	if m.MessageID != "" {
+		return m.MessageID
+	}
+
+	if m.logID == "" {
+		m.logID = uuid.NewString()
+	}
+
+	return m.logID
+}
+
+// logSampler lets the first initial lines of every second through and then
+// only every thereafter-th one, dropping the rest when thereafter is 0.
+type logSampler struct {
+	initial    int
+	thereafter int
+
+	mu     sync.Mutex
+	window time.Time
+	count  int
+}
+
+func (s *logSampler) allow() bool {
+	if s == nil {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.window) >= time.Second {
+		s.window = now
+		s.count = 0
+	}
+
+	s.count++
+	if s.count <= s.initial {
+		return true
+	}
+
+	return s.thereafter > 0 && (s.count-s.initial)%s.thereafter == 0
+}
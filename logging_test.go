@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/log"
+)
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		name          string
+		cfg           LogConfig
+		expectedLevel log.Level
+		expectError   bool
+	}{
+		{name: "defaults", cfg: LogConfig{}, expectedLevel: log.InfoLevel},
+		{name: "debug json", cfg: LogConfig{Level: "debug", Format: LogFormatJSON}, expectedLevel: log.DebugLevel},
+		{name: "warn logfmt", cfg: LogConfig{Level: "warn", Format: LogFormatLogfmt}, expectedLevel: log.WarnLevel},
+		{name: "unknown level", cfg: LogConfig{Level: "verbose"}, expectError: true},
+		{name: "unknown format", cfg: LogConfig{Format: "xml"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, err := NewLogger(tt.cfg)
+			if tt.expectError {
+				if err == nil {
+					t.Error("expected error but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("NewLogger() unexpected error: %v", err)
+			}
+			if logger.GetLevel() != tt.expectedLevel {
+				t.Errorf("expected level %v, got %v", tt.expectedLevel, logger.GetLevel())
+			}
+		})
+	}
+}
+
+func TestNewMessageLog_InvalidBody(t *testing.T) {
+	if _, err := NewMessageLog(LogConfig{Body: "some"}); err == nil {
+		t.Error("expected error but got none")
+	}
+}
+
+func TestMessageLog_Body(t *testing.T) {
+	body := []byte(strings.Repeat("a", 300))
+
+	tests := []struct {
+		name     string
+		cfg      LogConfig
+		expected string
+		logged   bool
+	}{
+		{name: "truncated by default", cfg: LogConfig{}, expected: strings.Repeat("a", defaultLogBodyLimit) + "... (300 bytes)", logged: true},
+		{name: "custom limit", cfg: LogConfig{Body: LogBodyTruncated, BodyLimit: 4}, expected: "aaaa... (300 bytes)", logged: true},
+		{name: "full", cfg: LogConfig{Body: LogBodyFull}, expected: string(body), logged: true},
+		{name: "off", cfg: LogConfig{Body: LogBodyOff}, logged: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messageLog, err := NewMessageLog(tt.cfg)
+			if err != nil {
+				t.Fatalf("NewMessageLog() unexpected error: %v", err)
+			}
+
+			result, logged := messageLog.body(body)
+			if logged != tt.logged || result != tt.expected {
+				t.Errorf("expected %q (%v), got %q (%v)", tt.expected, tt.logged, result, logged)
+			}
+		})
+	}
+}
+
+func TestMessageLog_ReceivedCarriesCorrelationID(t *testing.T) {
+	var buf bytes.Buffer
+	previous := Log
+	Log = log.NewWithOptions(&buf, log.Options{Formatter: log.JSONFormatter})
+	defer func() { Log = previous }()
+
+	messageLog, err := NewMessageLog(LogConfig{Body: LogBodyOff})
+	if err != nil {
+		t.Fatalf("NewMessageLog() unexpected error: %v", err)
+	}
+	messageLog.Received(&Message{Body: []byte("secret"), CorrelationID: "abc-123"})
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Failed to decode log line %q: %v", buf.String(), err)
+	}
+	if line[correlationKey] != "abc-123" {
+		t.Errorf("expected correlation id abc-123, got %v", line[correlationKey])
+	}
+	if _, ok := line["body"]; ok {
+		t.Errorf("expected body to be left out, got %v", line)
+	}
+	if line["bytes"] != float64(6) {
+		t.Errorf("expected body size to be logged, got %v", line["bytes"])
+	}
+}
+
+func TestMessageLog_ReceivedReportsCaller(t *testing.T) {
+	var buf bytes.Buffer
+	previous := Log
+	Log = log.NewWithOptions(&buf, log.Options{Formatter: log.JSONFormatter, ReportCaller: true})
+	defer func() { Log = previous }()
+
+	var messageLog *MessageLog
+	messageLog.Received(&Message{Body: []byte("cpu")})
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Failed to decode log line %q: %v", buf.String(), err)
+	}
+	if caller, _ := line["caller"].(string); !strings.Contains(caller, "logging_test.go") {
+		t.Errorf("expected the caller of Received to be reported, got %q", caller)
+	}
+}
+
+func TestMessage_LogID(t *testing.T) {
+	if id := (&Message{MessageID: "m1", CorrelationID: "c1"}).LogID(); id != "c1" {
+		t.Errorf("expected correlation id to win, got %s", id)
+	}
+	if id := (&Message{MessageID: "m1"}).LogID(); id != "m1" {
+		t.Errorf("expected message id, got %s", id)
+	}
+
+	msg := &Message{}
+	id := msg.LogID()
+	if id == "" {
+		t.Fatal("expected generated id")
+	}
+	if msg.LogID() != id {
+		t.Errorf("expected generated id to be stable, got %s then %s", id, msg.LogID())
+	}
+	if (&Message{}).LogID() == id {
+		t.Error("expected generated ids to differ between messages")
+	}
+}
+
+func TestLogSampler(t *testing.T) {
+	sampler := &logSampler{initial: 2, thereafter: 3}
+
+	var allowed int
+	for i := 0; i < 11; i++ {
+		if sampler.allow() {
+			allowed++
+		}
+	}
+
+	// 2 initial lines, then the 3rd, 6th and 9th of the remaining 9.
+	if allowed != 5 {
+		t.Errorf("expected 5 lines allowed, got %d", allowed)
+	}
+
+	var unsampled *logSampler
+	if !unsampled.allow() {
+		t.Error("expected nil sampler to allow every line")
+	}
+}
+
+func TestIngestHandler_CorrelationID(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		expects string
+	}{
+		{name: "correlation header", headers: map[string]string{correlationHeader: "c1", requestIDHeader: "r1"}, expects: "c1"},
+		{name: "request id header", headers: map[string]string{requestIDHeader: "r1"}, expects: "r1"},
+		{name: "generated", headers: map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewApiServer(ApiConfig{}, NewInfluxSink(&fakeWriteAPI{}), nil, nil)
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/metrics", strings.NewReader(metricBody("cpu")))
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			rec := httptest.NewRecorder()
+			server.Handler.ServeHTTP(rec, req)
+
+			id := rec.Header().Get(correlationHeader)
+			if id == "" || (tt.expects != "" && id != tt.expects) {
+				t.Errorf("expected correlation id %q, got %q", tt.expects, id)
+			}
+		})
+	}
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/charmbracelet/log"
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 )
 
-var Log *log.Logger
+var Log = log.Default()
 
 func main() {
 	Log = log.NewWithOptions(os.Stderr, log.Options{
@@ -30,37 +33,216 @@ func main() {
 		configPath = filepath.Join(cwd, "config.yml")
 	}
 
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:], configPath, os.Stdout))
+	}
+
+	os.Exit(run(configPath))
+}
+
+// run starts carrot with the config at configPath and returns the exit code
+// once it shut down. Bad config or a source that cannot start exits with 1,
+// so orchestrators see the failure.
+func run(configPath string) int {
 	cfg, err := ReadConfig(configPath)
 	if err != nil {
-		Log.Error("Cannot read config file", "err", err)
-		return
+		logConfigError("Cannot read config file", err)
+		return 1
+	}
+
+	if err := cfg.Validate(); err != nil {
+		logConfigError("Invalid config", err)
+		return 1
+	}
+
+	logger, err := NewLogger(cfg.Logging)
+	if err != nil {
+		Log.Error("Invalid logging config", "err", err)
+		return 1
+	}
+	Log = logger
+
+	messageLog, err := NewMessageLog(cfg.Logging)
+	if err != nil {
+		Log.Error("Invalid logging config", "err", err)
+		return 1
+	}
+
+	validator, err := NewValidator(cfg.Validation)
+	if err != nil {
+		Log.Error("Invalid validation config", "err", err)
+		return 1
 	}
 
-	client := influxdb2.NewClient(cfg.InfluxdbConfig.Url, cfg.InfluxdbConfig.Token)
-	writeAPI := client.WriteAPIBlocking(cfg.InfluxdbConfig.Org, cfg.InfluxdbConfig.Bucket)
+	shutdown, stop := NotifyShutdown(cfg.ShutdownTimeout)
+	defer stop()
 
-	msgs, err := ConsumeMessages(cfg)
+	sink, err := OpenSinks(cfg)
 	if err != nil {
-		Log.Error("Cannot consume messages from rabbitmq", "err", err)
-		return 
+		Log.Error("Cannot open sinks", "err", err)
+		return 1
+	}
+	defer func() {
+		if err := closeWithin(shutdown.Deadline(), sink); err != nil {
+			Log.Error("Cannot close sinks", "err", err)
+		}
+	}()
+
+	newPipeline := func(name string, source Source, format string, timeCfg TimeConfig) *Pipeline {
+		return &Pipeline{
+			Name:                name,
+			Source:              source,
+			Sink:                sink,
+			Batch:               cfg.InfluxdbConfig.Batch,
+			Format:              format,
+			MaxDecompressedSize: cfg.MaxDecompressedSize,
+			Time:                timeCfg,
+			Validator:           validator,
+			MessageLog:          messageLog,
+		}
+	}
+
+	var pipelines []*Pipeline
+	if cfg.Rabbit.Host != "" {
+		consumer, err := ConsumeMessages(cfg)
+		if err != nil {
+			Log.Error("Cannot consume messages from rabbitmq", "err", err)
+			return 1
+		}
+		pipelines = append(pipelines, newPipeline(SourceRabbit, consumer, cfg.Rabbit.Format, cfg.Rabbit.Time))
+	}
+
+	if len(cfg.Kafka.Brokers) > 0 {
+		source, err := ConsumeKafka(cfg.Kafka)
+		if err != nil {
+			Log.Error("Cannot consume messages from kafka", "err", err)
+			return 1
+		}
+		source.MessageLog = messageLog
+		pipelines = append(pipelines, newPipeline(SourceKafka, source, cfg.Kafka.Format, cfg.Kafka.Time))
+	}
+
+	if cfg.Mqtt.Broker != "" {
+		source, err := ConsumeMqtt(cfg.Mqtt)
+		if err != nil {
+			Log.Error("Cannot consume messages from mqtt", "err", err)
+			return 1
+		}
+		source.MessageLog = messageLog
+		pipelines = append(pipelines, newPipeline(SourceMqtt, source, cfg.Mqtt.Format, cfg.Mqtt.Time))
 	}
 
-	Log.Info("Waiting for messages...")
-	for msg := range msgs {
-		Log.Info("Received! ", "body", string(msg.Body))
-		metric, err := ConsumeMessage(msg.Body)
+	if cfg.Nats.Url != "" {
+		source, err := ConsumeNats(cfg.Nats)
 		if err != nil {
-			Log.Error("Cannot consume rabbit msg", "err", err)
-			continue
+			Log.Error("Cannot consume messages from nats", "err", err)
+			return 1
 		}
+		source.MessageLog = messageLog
+		pipelines = append(pipelines, newPipeline(SourceNats, source, cfg.Nats.Format, cfg.Nats.Time))
+	}
+
+	health := NewHealth()
+	health.Add(sink)
+	for _, p := range pipelines {
+		health.Add(p.Source)
+	}
+
+	var server *http.Server
+	if cfg.Api.Port != 0 {
+		server = NewApiServer(cfg.Api, sink, validator, health)
+		go func() {
+			Log.Info("Listening for metrics over http", "addr", server.Addr)
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				Log.Error("Cannot serve http api", "err", err)
+			}
+		}()
+	}
+
+	var admin *http.Server
+	if cfg.Admin.Port != 0 {
+		admin = NewAdminServer(cfg.Admin, health)
+		go func() {
+			Log.Info("Serving admin endpoints", "addr", admin.Addr)
+			if err := admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				Log.Error("Cannot serve admin endpoints", "err", err)
+			}
+		}()
+	}
+
+	Log.Info("Waiting for messages...", "sources", len(pipelines))
+	result := make(chan error, 1)
+	go func() {
+		result <- RunPipelines(shutdown, pipelines...)
+	}()
+
+	select {
+	case <-shutdown.Done():
+	case err := <-result:
+		result <- err
+	}
+
+	// Every stage below shares the deadline. The api stops taking writes
+	// first, while the sources drain into the sinks.
+	deadline := shutdown.Deadline()
+	if server != nil {
+		if err := server.Shutdown(deadline); err != nil {
+			Log.Error("Cannot shut down http api", "err", err)
+		}
+	}
+
+	if err := <-result; err != nil {
+		Log.Error("Pipeline did not shut down cleanly", "err", err)
+	}
+
+	if admin != nil {
+		if err := admin.Shutdown(deadline); err != nil {
+			Log.Error("Cannot shut down admin endpoints", "err", err)
+		}
+	}
+
+	Log.Info("Shutdown complete")
+	return 0
+}
+
+// runCommand runs a subcommand and returns the exit code. `config check
+// [path]` validates the config the way startup does and prints every problem.
+func runCommand(args []string, configPath string, out io.Writer) int {
+	if len(args) < 2 || len(args) > 3 || args[0] != "config" || args[1] != "check" {
+		fmt.Fprintln(out, "usage: carrot [config check [path]]")
+		return 2
+	}
+
+	if len(args) == 3 {
+		configPath = args[2]
+	}
 
-		if err := SendMetric(writeAPI, metric); err != nil {
-			Log.Error("Cannot send metric to influxdb", "err", err)
-			continue
+	if err := CheckConfig(configPath); err != nil {
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			fmt.Fprintf(out, "%s: %v\n", configPath, err)
+			return 1
 		}
 
-		Log.Info("Send new metric to influxdb")
-		msg.Ack(false)
+		for _, issue := range validationErr.Issues {
+			fmt.Fprintf(out, "%s: %s: %s\n", configPath, issue.Path, issue.Message)
+		}
+		return 1
+	}
+
+	fmt.Fprintf(out, "%s: ok\n", configPath)
+	return 0
+}
+
+// logConfigError logs each problem of a *ValidationError on its own line.
+func logConfigError(msg string, err error) {
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		Log.Error(msg, "err", err)
+		return
+	}
+
+	for _, issue := range validationErr.Issues {
+		Log.Error(msg, "path", issue.Path, "err", issue.Message)
 	}
 }
-		
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrSourceCancelled is returned for messages published after the source
+// stopped handing messages to the pipeline.
+var ErrSourceCancelled = errors.New("memory source is cancelled")
+
+type MemoryOutcome struct {
+	Body   []byte
+	Acked  bool
+	Retry  bool
+	Stage  string
+	Reason error
+}
+
+// MemorySource is an in-process Source. Published bodies are handed to the
+// pipeline in order and their outcomes recorded, which lets the whole
+// pipeline run without a broker.
+type MemorySource struct {
+	messages   chan *Message
+	done       chan struct{}
+	cancelOnce sync.Once
+
+	// sendMu keeps Cancel from closing messages while a publish is sending.
+	sendMu    sync.RWMutex
+	cancelled bool
+
+	mu       sync.Mutex
+	outcomes map[int]MemoryOutcome
+	next     int
+	closed   bool
+}
+
+func NewMemorySource(buffer int) *MemorySource {
+	return &MemorySource{
+		messages: make(chan *Message, buffer),
+		done:     make(chan struct{}),
+		outcomes: make(map[int]MemoryOutcome),
+	}
+}
+
+func (s *MemorySource) Publish(body []byte) error {
+	return s.PublishMessage(&Message{Body: body})
+}
+
+// PublishMessage hands msg to the pipeline, replacing its Ack and Nack with
+// ones that record the outcome. Once the source is cancelled msg is dropped
+// and ErrSourceCancelled returned.
+func (s *MemorySource) PublishMessage(msg *Message) error {
+	s.sendMu.RLock()
+	defer s.sendMu.RUnlock()
+
+	if s.cancelled {
+		return ErrSourceCancelled
+	}
+
+	s.mu.Lock()
+	id := s.next
+	s.next++
+	s.mu.Unlock()
+
+	msg.Ack = func() error {
+		s.settle(id, MemoryOutcome{Body: msg.Body, Acked: true})
+		return nil
+	}
+	msg.Nack = func(stage string, reason error, retry bool) error {
+		s.settle(id, MemoryOutcome{Body: msg.Body, Retry: retry, Stage: stage, Reason: reason})
+		return nil
+	}
+
+	select {
+	case s.messages <- msg:
+		return nil
+	case <-s.done:
+		return ErrSourceCancelled
+	}
+}
+
+func (s *MemorySource) settle(id int, outcome MemoryOutcome) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.outcomes[id] = outcome
+}
+
+// Outcomes returns how every settled message ended up, in publish order.
+func (s *MemorySource) Outcomes() []MemoryOutcome {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var outcomes []MemoryOutcome
+	for id := 0; id < s.next; id++ {
+		if outcome, ok := s.outcomes[id]; ok {
+			outcomes = append(outcomes, outcome)
+		}
+	}
+
+	return outcomes
+}
+
+func (s *MemorySource) Messages() <-chan *Message {
+	return s.messages
+}
+
+func (s *MemorySource) Cancel() error {
+	s.cancelOnce.Do(func() {
+		// Release blocked publishers before waiting for them to return.
+		close(s.done)
+
+		s.sendMu.Lock()
+		defer s.sendMu.Unlock()
+
+		s.cancelled = true
+		close(s.messages)
+	})
+
+	return nil
+}
+
+func (s *MemorySource) Close() error {
+	s.Cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	return nil
+}
+
+func (s *MemorySource) Closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemorySource_Outcomes(t *testing.T) {
+	source := NewMemorySource(3)
+	source.Publish([]byte("first"))
+	source.Publish([]byte("second"))
+	source.Publish([]byte("third"))
+	source.Cancel()
+
+	var msgs []*Message
+	for msg := range source.Messages() {
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(msgs))
+	}
+
+	reason := errors.New("bad json")
+	msgs[2].Ack()
+	msgs[0].Nack(StageParse, reason, false)
+
+	outcomes := source.Outcomes()
+	if len(outcomes) != 2 {
+		t.Fatalf("expected 2 settled messages, got %+v", outcomes)
+	}
+	if string(outcomes[0].Body) != "first" || outcomes[0].Acked || outcomes[0].Stage != StageParse || !errors.Is(outcomes[0].Reason, reason) {
+		t.Errorf("unexpected outcome for first message: %+v", outcomes[0])
+	}
+	if string(outcomes[1].Body) != "third" || !outcomes[1].Acked {
+		t.Errorf("unexpected outcome for third message: %+v", outcomes[1])
+	}
+}
+
+func TestMemorySource_Pipeline(t *testing.T) {
+	source := NewMemorySource(10)
+	writeAPI := &fakeWriteAPI{}
+	pipeline := &Pipeline{
+		Source: source,
+		Sink:   NewInfluxSink(writeAPI),
+		Batch:  BatchConfig{Size: 2, FlushInterval: time.Hour},
+	}
+
+	for _, name := range []string{"cpu", "mem", "disk"} {
+		source.Publish([]byte(metricBody(name)))
+	}
+	source.Publish([]byte(`{"metrics": [{"name": "cpu", "value": 1}]}`))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := pipeline.RunContext(ctx); err != nil {
+		t.Fatalf("RunContext() returned error: %v", err)
+	}
+
+	outcomes := source.Outcomes()
+	if len(outcomes) != 4 {
+		t.Fatalf("expected every message to be settled, got %+v", outcomes)
+	}
+	for i, outcome := range outcomes[:3] {
+		if !outcome.Acked {
+			t.Errorf("expected message %d to be acked, got %+v", i, outcome)
+		}
+	}
+	if outcomes[3].Acked || outcomes[3].Stage != StageParse {
+		t.Errorf("expected message without timestamp to fail parsing, got %+v", outcomes[3])
+	}
+	if len(writeAPI.Points()) != 3 {
+		t.Errorf("expected 3 points written, got %d", len(writeAPI.Points()))
+	}
+}
+
+func TestMemorySource_PublishAfterCancel(t *testing.T) {
+	source := NewMemorySource(0)
+
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- source.Publish([]byte("in flight"))
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	source.Close()
+
+	select {
+	case err := <-blocked:
+		if !errors.Is(err, ErrSourceCancelled) {
+			t.Errorf("expected blocked publish to be dropped, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Close() to release the blocked publish")
+	}
+
+	if err := source.Publish([]byte("late")); !errors.Is(err, ErrSourceCancelled) {
+		t.Errorf("expected publish after cancel to be dropped, got %v", err)
+	}
+	if outcomes := source.Outcomes(); len(outcomes) != 0 {
+		t.Errorf("expected dropped messages to have no outcome, got %+v", outcomes)
+	}
+}
@@ -1,52 +1,226 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type RawMetric struct {
-	Name      string      `json:"name"`
-	Value     any         `json:"value"`
-	Timestamp any         `json:"time"`
+	Name      string            `json:"name"`
+	Value     any               `json:"value"`
+	Fields    map[string]any    `json:"fields"`
+	Tags      map[string]string `json:"tags"`
+	Timestamp any               `json:"time"`
 }
 
 type Metric struct {
 	Name      string
 	Value     any
+	Fields    map[string]any
 	Timestamp time.Time
 	Tags      map[string]string
 }
 
+// FieldMap returns the fields of the point written for m. Metrics without a
+// fields object keep the legacy shape of a single field named after the
+// measurement.
+func (m *Metric) FieldMap() map[string]any {
+	if len(m.Fields) > 0 {
+		return m.Fields
+	}
+
+	return map[string]any{m.Name: m.Value}
+}
+
+// UnmarshalJSON keeps numeric timestamps as json.Number so epoch values in
+// milliseconds or nanoseconds do not lose precision to float64.
+func (r *RawMetric) UnmarshalJSON(data []byte) error {
+	type rawMetric RawMetric
+	var aux struct {
+		rawMetric
+		Timestamp json.RawMessage `json:"time"`
+	}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	*r = RawMetric(aux.rawMetric)
+	r.Timestamp = nil
+	if len(aux.Timestamp) == 0 {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(aux.Timestamp))
+	decoder.UseNumber()
+	return decoder.Decode(&r.Timestamp)
+}
+
+var timeLayouts = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC822":      time.RFC822,
+	"RFC822Z":     time.RFC822Z,
+	"RFC850":      time.RFC850,
+	"DateTime":    time.DateTime,
+}
+
+var precisions = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
 func ParseTime(ts any) (time.Time, error) {
+	return ParseTimeWith(ts, TimeConfig{})
+}
+
+// ParseTimeWith parses string timestamps with the configured layouts (RFC3339
+// by default) and numeric ones as epoch values in the configured precision
+// (seconds by default).
+func ParseTimeWith(ts any, cfg TimeConfig) (time.Time, error) {
+	unit := time.Second
+	if cfg.Precision != "" {
+		var ok bool
+		unit, ok = precisions[cfg.Precision]
+		if !ok {
+			return time.Time{}, fmt.Errorf("unsupported timestamp precision: %s", cfg.Precision)
+		}
+	}
+
 	switch v := ts.(type) {
-	case string:
-		t, err := time.Parse(time.RFC3339, v)
-		if err != nil {
-			return time.Time{}, err
+	case nil:
+		if cfg.DefaultToNow {
+			return time.Now(), nil
 		}
-		return t, nil
+		return time.Time{}, fmt.Errorf("missing timestamp")
+	case string:
+		return parseTimeString(v, cfg.Layouts)
+	case json.Number:
+		return parseEpoch(v.String(), unit)
 	case float64:
-		sec := int64(v)
-		nsecFloat := v - float64(sec)
-		nsec := int64(nsecFloat * 1e9)
-		return time.Unix(sec, nsec), nil
+		whole := int64(v)
+		frac := v - float64(whole)
+		return epochTime(whole, int64(frac*float64(unit)), unit)
 	case int64:
-		seconds := v
-		return time.Unix(seconds, 0), nil
+		return epochTime(v, 0, unit)
+	case uint64:
+		if v > math.MaxInt64 {
+			return time.Time{}, fmt.Errorf("epoch timestamp %d out of range", v)
+		}
+		return epochTime(int64(v), 0, unit)
+	case time.Time:
+		return v, nil
 	default:
 		return time.Time{}, fmt.Errorf("unsupported timestamp type: %T", ts)
 	}
 }
 
+func parseTimeString(v string, layouts []string) (time.Time, error) {
+	if len(layouts) == 0 {
+		return time.Parse(time.RFC3339, v)
+	}
+
+	var err error
+	for _, layout := range layouts {
+		if named, ok := timeLayouts[layout]; ok {
+			layout = named
+		}
+
+		var t time.Time
+		t, err = time.Parse(layout, v)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, err
+}
+
+// parseEpoch parses a decimal epoch value exactly, falling back to float
+// parsing only for exponent notation.
+func parseEpoch(v string, unit time.Duration) (time.Time, error) {
+	if strings.ContainsAny(v, "eE") {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return ParseTimeWith(f, TimeConfig{Precision: precisionName(unit)})
+	}
+
+	intPart, fracPart, _ := strings.Cut(v, ".")
+	whole, err := strconv.ParseInt(intPart, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid epoch timestamp %s: %v", v, err)
+	}
+
+	var frac int64
+	if fracPart != "" {
+		// Scale the fraction to nanoseconds of one unit, dropping digits
+		// beyond nanosecond resolution.
+		digits := fracPart + strings.Repeat("0", 9)
+		frac, err = strconv.ParseInt(digits[:9], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid epoch timestamp %s: %v", v, err)
+		}
+		frac = frac * int64(unit) / int64(time.Second)
+		if strings.HasPrefix(intPart, "-") {
+			frac = -frac
+		}
+	}
+
+	return epochTime(whole, frac, unit)
+}
+
+func epochTime(whole int64, fracNanos int64, unit time.Duration) (time.Time, error) {
+	if unit == time.Second {
+		return time.Unix(whole, fracNanos), nil
+	}
+
+	if whole > math.MaxInt64/int64(unit) || whole < math.MinInt64/int64(unit) {
+		return time.Time{}, fmt.Errorf("epoch timestamp %d out of range for precision %s", whole, precisionName(unit))
+	}
+
+	return time.Unix(0, whole*int64(unit)+fracNanos), nil
+}
+
+func precisionName(unit time.Duration) string {
+	for name, d := range precisions {
+		if d == unit {
+			return name
+		}
+	}
+
+	return ""
+}
+
 func ConsumeMessage(data []byte) ([]*Metric, error) {
+	return ConsumeMessageWith(data, TimeConfig{})
+}
+
+// ConsumeMessageWith parses an envelope using the timestamp settings of the
+// source it came from. An envelope-level _precision key overrides the
+// configured precision.
+func ConsumeMessageWith(data []byte, cfg TimeConfig) ([]*Metric, error) {
 	var raw map[string]json.RawMessage
 	if err := json.Unmarshal(data, &raw); err != nil {
 		return nil, err
 	}
 
+	if precision, ok := raw["_precision"]; ok {
+		if err := json.Unmarshal(precision, &cfg.Precision); err != nil {
+			return nil, fmt.Errorf("invalid _precision: %v", err)
+		}
+	}
+
 	tags := make(map[string]string)
 	for k, v := range raw {
 		if k == "metrics" || strings.HasPrefix(k, "_") {
@@ -68,7 +242,7 @@ func ConsumeMessage(data []byte) ([]*Metric, error) {
 
 	var metrics []*Metric
 	for _, rawMetric := range rawMetrics {
-		t, err := ParseTime(rawMetric.Timestamp)
+		t, err := ParseTimeWith(rawMetric.Timestamp, cfg)
 		if err != nil {
 			return nil, fmt.Errorf("invalid timestamp: %v", err)
 		}
@@ -76,8 +250,9 @@ func ConsumeMessage(data []byte) ([]*Metric, error) {
 		metric := &Metric{
 			Name:      rawMetric.Name,
 			Value:     rawMetric.Value,
+			Fields:    rawMetric.Fields,
 			Timestamp: t,
-			Tags:      tags,
+			Tags:      mergeTags(tags, rawMetric.Tags),
 		}
 
 		metrics = append(metrics, metric)
@@ -85,3 +260,18 @@ func ConsumeMessage(data []byte) ([]*Metric, error) {
 
 	return metrics, nil
 }
+
+// mergeTags returns a new map holding the envelope tags overridden by the
+// metric's own tags.
+func mergeTags(envelope map[string]string, metric map[string]string) map[string]string {
+	tags := make(map[string]string, len(envelope)+len(metric))
+	for k, v := range envelope {
+		tags[k] = v
+	}
+
+	for k, v := range metric {
+		tags[k] = v
+	}
+
+	return tags
+}
@@ -72,6 +72,157 @@ func TestParseTime(t *testing.T) {
 	}
 }
 
+func TestParseTimeWith(t *testing.T) {
+	expected := time.Date(2023, 10, 15, 14, 30, 45, 123456789, time.UTC)
+
+	tests := []struct {
+		name        string
+		input       any
+		cfg         TimeConfig
+		expected    time.Time
+		expectError bool
+	}{
+		{
+			name:     "seconds with exact fraction",
+			input:    json.Number("1697380245.123456789"),
+			expected: expected,
+		},
+		{
+			name:     "milliseconds",
+			input:    json.Number("1697380245123"),
+			cfg:      TimeConfig{Precision: "ms"},
+			expected: expected.Truncate(time.Millisecond),
+		},
+		{
+			name:     "microseconds",
+			input:    json.Number("1697380245123456"),
+			cfg:      TimeConfig{Precision: "us"},
+			expected: expected.Truncate(time.Microsecond),
+		},
+		{
+			name:     "nanoseconds",
+			input:    json.Number("1697380245123456789"),
+			cfg:      TimeConfig{Precision: "ns"},
+			expected: expected,
+		},
+		{
+			name:     "fractional milliseconds",
+			input:    json.Number("1697380245123.5"),
+			cfg:      TimeConfig{Precision: "ms"},
+			expected: time.Date(2023, 10, 15, 14, 30, 45, 123500000, time.UTC),
+		},
+		{
+			name:     "exponent notation",
+			input:    json.Number("1.697380245e9"),
+			expected: time.Date(2023, 10, 15, 14, 30, 45, 0, time.UTC),
+		},
+		{
+			name:     "int64 milliseconds",
+			input:    int64(1697380245123),
+			cfg:      TimeConfig{Precision: "ms"},
+			expected: expected.Truncate(time.Millisecond),
+		},
+		{
+			name:        "nanoseconds out of range for seconds precision",
+			input:       json.Number("1697380245123456789"),
+			cfg:         TimeConfig{Precision: "ms"},
+			expectError: true,
+		},
+		{
+			name:        "unsupported precision",
+			input:       json.Number("1697380245"),
+			cfg:         TimeConfig{Precision: "minutes"},
+			expectError: true,
+		},
+		{
+			name:     "RFC3339Nano",
+			input:    "2023-10-15T14:30:45.123456789Z",
+			cfg:      TimeConfig{Layouts: []string{"RFC3339Nano"}},
+			expected: expected,
+		},
+		{
+			name:     "RFC1123 after other layouts",
+			input:    "Sun, 15 Oct 2023 14:30:45 UTC",
+			cfg:      TimeConfig{Layouts: []string{"RFC3339", "RFC1123"}},
+			expected: time.Date(2023, 10, 15, 14, 30, 45, 0, time.UTC),
+		},
+		{
+			name:     "custom layout",
+			input:    "15/10/2023 14:30:45",
+			cfg:      TimeConfig{Layouts: []string{"02/01/2006 15:04:05"}},
+			expected: time.Date(2023, 10, 15, 14, 30, 45, 0, time.UTC),
+		},
+		{
+			name:        "no layout matches",
+			input:       "yesterday",
+			cfg:         TimeConfig{Layouts: []string{"RFC3339", "RFC1123"}},
+			expectError: true,
+		},
+		{
+			name:        "missing timestamp",
+			input:       nil,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ParseTimeWith(tt.input, tt.cfg)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("ParseTimeWith() expected error but got %v", result)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ParseTimeWith() unexpected error: %v", err)
+			}
+			if !result.Equal(tt.expected) {
+				t.Errorf("ParseTimeWith() = %v, expected %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseTimeWith_DefaultToNow(t *testing.T) {
+	before := time.Now()
+	result, err := ParseTimeWith(nil, TimeConfig{DefaultToNow: true})
+	if err != nil {
+		t.Fatalf("ParseTimeWith() unexpected error: %v", err)
+	}
+	if result.Before(before) || result.After(time.Now()) {
+		t.Errorf("expected receive time, got %v", result)
+	}
+}
+
+func TestConsumeMessageWith_EnvelopePrecision(t *testing.T) {
+	input := []byte(`{
+		"_precision": "ns",
+		"metrics": [{"name": "temp", "value": 21.5, "time": 1697380245123456789}]
+	}`)
+
+	metrics, err := ConsumeMessageWith(input, TimeConfig{Precision: "s"})
+	if err != nil {
+		t.Fatalf("ConsumeMessageWith() unexpected error: %v", err)
+	}
+
+	expected := time.Date(2023, 10, 15, 14, 30, 45, 123456789, time.UTC)
+	if !metrics[0].Timestamp.Equal(expected) {
+		t.Errorf("Timestamp = %v, expected %v", metrics[0].Timestamp, expected)
+	}
+	if _, ok := metrics[0].Tags["_precision"]; ok {
+		t.Error("expected _precision not to become a tag")
+	}
+	if metrics[0].Value != 21.5 {
+		t.Errorf("expected value to stay float64 21.5, got %v (%T)", metrics[0].Value, metrics[0].Value)
+	}
+
+	if _, err := ConsumeMessageWith([]byte(`{"_precision": 9, "metrics": []}`), TimeConfig{}); err == nil {
+		t.Error("expected error for non-string _precision")
+	}
+}
+
 func TestConsumeMessage(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -82,11 +233,11 @@ func TestConsumeMessage(t *testing.T) {
 		{
 			name: "valid message with metric and tags",
 			input: []byte(`{
-				"metric": {
+				"metrics": [{
 					"name": "cpu_usage",
 					"value": 75.5,
 					"time": "2023-10-15T14:30:45Z"
-				},
+				}],
 				"host": "server1",
 				"region": "us-east-1"
 			}`),
@@ -104,11 +255,11 @@ func TestConsumeMessage(t *testing.T) {
 		{
 			name: "metric with string value",
 			input: []byte(`{
-				"metric": {
+				"metrics": [{
 					"name": "status",
 					"value": "healthy",
 					"time": "2023-10-15T14:30:45Z"
-				},
+				}],
 				"service": "api"
 			}`),
 			expected: &Metric{
@@ -124,11 +275,11 @@ func TestConsumeMessage(t *testing.T) {
 		{
 			name: "metric with integer value",
 			input: []byte(`{
-				"metric": {
+				"metrics": [{
 					"name": "request_count",
 					"value": 1000,
 					"time": "2023-10-15T14:30:45Z"
-				}
+				}]
 			}`),
 			expected: &Metric{
 				Name:      "request_count",
@@ -138,14 +289,51 @@ func TestConsumeMessage(t *testing.T) {
 			},
 			expectError: false,
 		},
+		{
+			name: "metric with multiple fields",
+			input: []byte(`{
+				"metrics": [{
+					"name": "cpu",
+					"fields": {"user": 12.5, "system": 3.1, "idle": 84.4, "throttled": false},
+					"time": "2023-10-15T14:30:45Z"
+				}],
+				"host": "server1"
+			}`),
+			expected: &Metric{
+				Name: "cpu",
+				Fields: map[string]any{
+					"user":      12.5,
+					"system":    3.1,
+					"idle":      84.4,
+					"throttled": false,
+				},
+				Timestamp: time.Date(2023, 10, 15, 14, 30, 45, 0, time.UTC),
+				Tags: map[string]string{
+					"host": "server1",
+				},
+			},
+			expectError: false,
+		},
+		{
+			name: "invalid fields - array instead of object",
+			input: []byte(`{
+				"metrics": [{
+					"name": "cpu",
+					"fields": [1, 2, 3],
+					"time": "2023-10-15T14:30:45Z"
+				}]
+			}`),
+			expected:    nil,
+			expectError: true,
+		},
 		{
 			name: "message with underscore prefixed fields (should be ignored)",
 			input: []byte(`{
-				"metric": {
+				"metrics": [{
 					"name": "memory_usage",
 					"value": 60.2,
 					"time": "2023-10-15T14:30:45Z"
-				},
+				}],
 				"_internal": "should_be_ignored",
 				"_debug": "also_ignored",
 				"environment": "prod"
@@ -161,21 +349,13 @@ func TestConsumeMessage(t *testing.T) {
 			expectError: false,
 		},
 		{
-			name: "message without metric field",
+			name: "message without metrics field",
 			input: []byte(`{
 				"host": "server1",
 				"region": "us-east-1"
 			}`),
-			expected: &Metric{
-				Name:      "",
-				Value:     nil,
-				Timestamp: time.Time{},
-				Tags: map[string]string{
-					"host":   "server1",
-					"region": "us-east-1",
-				},
-			},
-			expectError: false,
+			expected:    nil,
+			expectError: true,
 		},
 		{
 			name:        "invalid JSON",
@@ -186,7 +366,7 @@ func TestConsumeMessage(t *testing.T) {
 		{
 			name: "invalid metric JSON - malformed object",
 			input: []byte(`{
-				"metric": {invalid},
+				"metrics": [{invalid}],
 				"host": "server1"
 			}`),
 			expected:    nil,
@@ -195,7 +375,7 @@ func TestConsumeMessage(t *testing.T) {
 		{
 			name: "invalid metric JSON - missing quotes",
 			input: []byte(`{
-				"metric": {name: "test", value: 123, time: "2023-10-15T14:30:45Z"},
+				"metrics": [{name: "test", value: 123, time: "2023-10-15T14:30:45Z"}],
 				"host": "server1"
 			}`),
 			expected:    nil,
@@ -204,7 +384,7 @@ func TestConsumeMessage(t *testing.T) {
 		{
 			name: "invalid metric JSON - array instead of object",
 			input: []byte(`{
-				"metric": ["name", "value", "time"],
+				"metrics": ["name", "value", "time"],
 				"host": "server1"
 			}`),
 			expected:    nil,
@@ -213,7 +393,7 @@ func TestConsumeMessage(t *testing.T) {
 		{
 			name: "invalid metric JSON - string instead of object",
 			input: []byte(`{
-				"metric": "not an object",
+				"metrics": "not an object",
 				"host": "server1"
 			}`),
 			expected:    nil,
@@ -222,7 +402,7 @@ func TestConsumeMessage(t *testing.T) {
 		{
 			name: "invalid metric JSON - number instead of object",
 			input: []byte(`{
-				"metric": 12345,
+				"metrics": 12345,
 				"host": "server1"
 			}`),
 			expected:    nil,
@@ -231,11 +411,11 @@ func TestConsumeMessage(t *testing.T) {
 		{
 			name: "invalid timestamp in metric",
 			input: []byte(`{
-				"metric": {
+				"metrics": [{
 					"name": "cpu_usage",
 					"value": 75.5,
 					"time": "invalid-time"
-				}
+				}]
 			}`),
 			expected:    nil,
 			expectError: true,
@@ -243,11 +423,11 @@ func TestConsumeMessage(t *testing.T) {
 		{
 			name: "non-string tag value",
 			input: []byte(`{
-				"metric": {
+				"metrics": [{
 					"name": "cpu_usage",
 					"value": 75.5,
 					"time": "2023-10-15T14:30:45Z"
-				},
+				}],
 				"count": 123
 			}`),
 			expected:    nil,
@@ -256,22 +436,17 @@ func TestConsumeMessage(t *testing.T) {
 		{
 			name:        "empty JSON object",
 			input:       []byte(`{}`),
-			expected: &Metric{
-				Name:      "",
-				Value:     nil,
-				Timestamp: time.Time{},
-				Tags:      map[string]string{},
-			},
-			expectError: false,
+			expected:    nil,
+			expectError: true,
 		},
 		{
 			name: "metric with null value",
 			input: []byte(`{
-				"metric": {
+				"metrics": [{
 					"name": "null_test",
 					"value": null,
 					"time": "2023-10-15T14:30:45Z"
-				}
+				}]
 			}`),
 			expected: &Metric{
 				Name:      "null_test",
@@ -299,17 +474,12 @@ func TestConsumeMessage(t *testing.T) {
 				return
 			}
 			
-			if result == nil && tt.expected != nil {
-				t.Errorf("ConsumeMessage() returned nil, expected %+v", tt.expected)
-				return
-			}
-			
-			if result != nil && tt.expected == nil {
-				t.Errorf("ConsumeMessage() returned %+v, expected nil", result)
+			if len(result) != 1 {
+				t.Errorf("ConsumeMessage() returned %d metrics, expected 1", len(result))
 				return
 			}
 			
-			if result != nil && tt.expected != nil {
+			if result := result[0]; tt.expected != nil {
 				if result.Name != tt.expected.Name {
 					t.Errorf("ConsumeMessage() Name = %v, expected %v", result.Name, tt.expected.Name)
 				}
@@ -324,6 +494,10 @@ func TestConsumeMessage(t *testing.T) {
 						result.Timestamp, tt.expected.Timestamp)
 				}
 				
+				if !reflect.DeepEqual(result.Fields, tt.expected.Fields) {
+					t.Errorf("ConsumeMessage() Fields = %v, expected %v", result.Fields, tt.expected.Fields)
+				}
+				
 				if !reflect.DeepEqual(result.Tags, tt.expected.Tags) {
 					t.Errorf("ConsumeMessage() Tags = %v, expected %v", result.Tags, tt.expected.Tags)
 				}
@@ -332,6 +506,66 @@ func TestConsumeMessage(t *testing.T) {
 	}
 }
 
+func TestConsumeMessage_PerMetricTags(t *testing.T) {
+	input := []byte(`{
+		"region": "us-east-1",
+		"host": "gateway",
+		"metrics": [
+			{"name": "temp", "value": 21.5, "time": "2023-10-15T14:30:45Z", "tags": {"host": "sensor-a"}},
+			{"name": "temp", "value": 19.0, "time": "2023-10-15T14:30:45Z", "tags": {"host": "sensor-b", "room": "lab"}},
+			{"name": "uptime", "value": 3600, "time": "2023-10-15T14:30:45Z"}
+		]
+	}`)
+
+	metrics, err := ConsumeMessage(input)
+	if err != nil {
+		t.Fatalf("ConsumeMessage() unexpected error: %v", err)
+	}
+	if len(metrics) != 3 {
+		t.Fatalf("ConsumeMessage() returned %d metrics, expected 3", len(metrics))
+	}
+
+	expected := []map[string]string{
+		{"region": "us-east-1", "host": "sensor-a"},
+		{"region": "us-east-1", "host": "sensor-b", "room": "lab"},
+		{"region": "us-east-1", "host": "gateway"},
+	}
+	for i, tags := range expected {
+		if !reflect.DeepEqual(metrics[i].Tags, tags) {
+			t.Errorf("metric %d Tags = %v, expected %v", i, metrics[i].Tags, tags)
+		}
+	}
+
+	metrics[2].Tags["mutated"] = "yes"
+	if _, shared := metrics[0].Tags["mutated"]; shared {
+		t.Error("expected every metric to get its own tag map")
+	}
+}
+
+func TestConsumeMessage_InvalidPerMetricTags(t *testing.T) {
+	input := []byte(`{"metrics": [{"name": "temp", "value": 1, "time": "2023-10-15T14:30:45Z", "tags": {"floor": 3}}]}`)
+	if _, err := ConsumeMessage(input); err == nil {
+		t.Error("expected error for non-string per-metric tag value")
+	}
+}
+
+func TestMetricFieldMap(t *testing.T) {
+	legacy := &Metric{Name: "cpu_usage", Value: 75.5}
+	if fields := legacy.FieldMap(); !reflect.DeepEqual(fields, map[string]any{"cpu_usage": 75.5}) {
+		t.Errorf("FieldMap() = %v, expected single field named after the measurement", fields)
+	}
+
+	multi := &Metric{Name: "cpu", Value: 1.0, Fields: map[string]any{"user": 12.5, "idle": 84.4}}
+	if fields := multi.FieldMap(); !reflect.DeepEqual(fields, multi.Fields) {
+		t.Errorf("FieldMap() = %v, expected %v", fields, multi.Fields)
+	}
+
+	points := NewPoints([]*Metric{multi})
+	if len(points) != 1 || len(points[0].FieldList()) != 2 {
+		t.Errorf("expected a single point with 2 fields, got %d points", len(points))
+	}
+}
+
 // Benchmark tests
 func BenchmarkParseTime(b *testing.B) {
 	timestamp := "2023-10-15T14:30:45Z"
@@ -342,11 +576,11 @@ func BenchmarkParseTime(b *testing.B) {
 
 func BenchmarkConsumeMessage(b *testing.B) {
 	data := []byte(`{
-		"metric": {
+		"metrics": [{
 			"name": "cpu_usage",
 			"value": 75.5,
 			"time": "2023-10-15T14:30:45Z"
-		},
+		}],
 		"host": "server1",
 		"region": "us-east-1"
 	}`)
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const mqttDisconnectQuiesce = 250 // milliseconds
+
+// MqttSource subscribes to topic filters and acks messages only once they
+// were written. MQTT has no way to reject a message, so failed writes are
+// redelivered in process and dead-lettered by publishing the payload to
+// DeadLetterTopic once MaxRetries is exhausted.
+type MqttSource struct {
+	cfg      MqttConfig
+	client   mqtt.Client
+	template *TopicTemplate
+	publish  func(topic string, payload []byte) error
+	queue    *messageQueue
+
+	// MessageLog writes the lines about single messages.
+	MessageLog *MessageLog
+
+	cancelOnce sync.Once
+}
+
+func ConsumeMqtt(cfg MqttConfig) (*MqttSource, error) {
+	source, err := newMqttSource(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	clientID := cfg.ClientID
+	if clientID == "" {
+		if cfg.PersistentSession {
+			return nil, errors.New("mqtt persistent sessions need a fixed client id")
+		}
+		clientID = consumerTag
+	}
+
+	// The connect handler runs again after every automatic reconnect.
+	var connected atomic.Bool
+	onConnect := func(client mqtt.Client) {
+		if connected.Swap(true) {
+			sourceReconnects.WithLabelValues(SourceMqtt).Inc()
+		}
+		source.subscribe(client)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(clientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetCleanSession(!cfg.PersistentSession).
+		SetAutoAckDisabled(true).
+		SetOrderMatters(false).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(defaultMaxReconnectDelay).
+		SetOnConnectHandler(onConnect).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			Log.Warn("Lost connection to mqtt broker, reconnecting", "err", err)
+		})
+
+	source.client = mqtt.NewClient(opts)
+	source.publish = func(topic string, payload []byte) error {
+		token := source.client.Publish(topic, byte(cfg.QoS), false, payload)
+		token.Wait()
+		return token.Error()
+	}
+
+	token := source.client.Connect()
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+
+	return source, nil
+}
+
+func newMqttSource(cfg MqttConfig) (*MqttSource, error) {
+	if len(cfg.Topics) == 0 {
+		return nil, errors.New("mqtt source needs at least one topic filter")
+	}
+
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		return nil, fmt.Errorf("unsupported mqtt qos: %d", cfg.QoS)
+	}
+
+	template, err := ParseTopicTemplate(cfg.TopicTemplate, "/", "+", "#")
+	if err != nil {
+		return nil, err
+	}
+
+	return &MqttSource{
+		cfg:      cfg,
+		template: template,
+		queue:    newMessageQueue(),
+	}, nil
+}
+
+// subscribe runs on every (re)connect, as a clean session loses its
+// subscriptions along with the connection.
+func (s *MqttSource) subscribe(client mqtt.Client) {
+	filters := make(map[string]byte, len(s.cfg.Topics))
+	for _, topic := range s.cfg.Topics {
+		filters[topic] = byte(s.cfg.QoS)
+	}
+
+	token := client.SubscribeMultiple(filters, s.receive)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		Log.Error("Cannot subscribe to mqtt topics", "topics", s.cfg.Topics, "err", err)
+		return
+	}
+
+	Log.Info("Subscribed to mqtt topics", "topics", s.cfg.Topics, "qos", s.cfg.QoS)
+}
+
+func (s *MqttSource) receive(client mqtt.Client, m mqtt.Message) {
+	msg := s.message(m)
+	if !s.queue.deliver(msg) {
+		s.MessageLog.For(msg).Warn("Dropping mqtt message received after shutdown", "topic", m.Topic())
+	}
+}
+
+func (s *MqttSource) message(m mqtt.Message) *Message {
+	msg := &Message{
+		Body:    m.Payload(),
+		Headers: map[string]any{"topic": m.Topic()},
+		Tags:    s.template.Tags(m.Topic()),
+		Raw:     m,
+	}
+
+	if m.Qos() > 0 {
+		msg.MessageID = strconv.Itoa(int(m.MessageID()))
+	}
+
+	retries := 0
+	msg.Ack = func() error {
+		m.Ack()
+		return nil
+	}
+	msg.Nack = func(stage string, reason error, retry bool) error {
+		if retry && retries < s.maxRetries() {
+			retries++
+			go s.redeliver(msg, retries)
+			return nil
+		}
+		return s.DeadLetter(msg, stage, reason)
+	}
+
+	return msg
+}
+
+// redeliver hands msg to the pipeline again after a backoff. Messages still
+// waiting when the source is cancelled stay unacked, so a persistent session
+// gets them again from the broker.
+func (s *MqttSource) redeliver(msg *Message, attempt int) {
+	select {
+	case <-time.After(backoffDelay(defaultInitialDelay, defaultMaxDelay, attempt)):
+	case <-s.queue.done:
+		return
+	}
+
+	s.queue.deliver(msg)
+}
+
+// DeadLetter publishes the payload of msg to DeadLetterTopic and acks it.
+// Without a dead-letter topic the message is dropped.
+func (s *MqttSource) DeadLetter(msg *Message, stage string, reason error) error {
+	m := msg.Raw.(mqtt.Message)
+	if s.cfg.DeadLetterTopic == "" {
+		s.MessageLog.For(msg).Warn("Dropping mqtt message", "topic", m.Topic(), "stage", stage, "err", reason)
+		m.Ack()
+		return nil
+	}
+
+	if err := s.publish(s.cfg.DeadLetterTopic, m.Payload()); err != nil {
+		return err
+	}
+
+	s.MessageLog.For(msg).Warn("Dead-lettered mqtt message", "topic", m.Topic(), "stage", stage, "err", reason)
+	m.Ack()
+	return nil
+}
+
+func (s *MqttSource) maxRetries() int {
+	if s.cfg.MaxRetries <= 0 {
+		return defaultMaxRetries
+	}
+
+	return s.cfg.MaxRetries
+}
+
+func (s *MqttSource) Messages() <-chan *Message {
+	return s.queue.messages
+}
+
+func (s *MqttSource) Cancel() error {
+	var err error
+	s.cancelOnce.Do(func() {
+		if s.client != nil {
+			token := s.client.Unsubscribe(s.cfg.Topics...)
+			token.Wait()
+			err = token.Error()
+		}
+
+		s.queue.close()
+	})
+
+	return err
+}
+
+func (s *MqttSource) Close() error {
+	err := s.Cancel()
+	if s.client != nil {
+		s.client.Disconnect(mqttDisconnectQuiesce)
+	}
+
+	return err
+}
+
+func (s *MqttSource) HealthChecks() []HealthCheck {
+	return []HealthCheck{{Name: SourceMqtt, Check: func(ctx context.Context) error {
+		if s.client == nil || !s.client.IsConnectionOpen() {
+			return errors.New("not connected to mqtt broker")
+		}
+		return nil
+	}}}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+type fakeMqttMessage struct {
+	topic   string
+	payload []byte
+	qos     byte
+
+	mu    sync.Mutex
+	acked int
+}
+
+func (f *fakeMqttMessage) Duplicate() bool   { return false }
+func (f *fakeMqttMessage) Qos() byte         { return f.qos }
+func (f *fakeMqttMessage) Retained() bool    { return false }
+func (f *fakeMqttMessage) Topic() string     { return f.topic }
+func (f *fakeMqttMessage) MessageID() uint16 { return 42 }
+func (f *fakeMqttMessage) Payload() []byte   { return f.payload }
+
+func (f *fakeMqttMessage) Ack() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.acked++
+}
+
+func (f *fakeMqttMessage) Acked() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.acked
+}
+
+func newTestMqttSource(t *testing.T, cfg MqttConfig) (*MqttSource, *[]string) {
+	t.Helper()
+
+	cfg.Topics = []string{"sensors/#"}
+	source, err := newMqttSource(cfg)
+	if err != nil {
+		t.Fatalf("newMqttSource() unexpected error: %v", err)
+	}
+
+	var published []string
+	source.publish = func(topic string, payload []byte) error {
+		published = append(published, topic)
+		return nil
+	}
+
+	return source, &published
+}
+
+func TestMqttSource_Message(t *testing.T) {
+	source, _ := newTestMqttSource(t, MqttConfig{QoS: 1, TopicTemplate: "sensors/{site}/{device}"})
+	m := &fakeMqttMessage{topic: "sensors/tlv/t-1000", payload: []byte(`{}`), qos: 1}
+
+	go source.receive(nil, m)
+	msg := <-source.Messages()
+
+	if msg.Tags["site"] != "tlv" || msg.Tags["device"] != "t-1000" || msg.MessageID != "42" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	msg.Ack()
+	if m.Acked() != 1 {
+		t.Errorf("expected message to be acked once, got %d", m.Acked())
+	}
+}
+
+func TestMqttSource_RetryThenDeadLetter(t *testing.T) {
+	source, published := newTestMqttSource(t, MqttConfig{MaxRetries: 1, DeadLetterTopic: "carrot/dead"})
+	m := &fakeMqttMessage{topic: "sensors/tlv/t-1000", payload: []byte(`{}`)}
+
+	go source.receive(nil, m)
+	msg := <-source.Messages()
+
+	if err := msg.Nack(StageWrite, errors.New("influx down"), true); err != nil {
+		t.Fatalf("Nack() unexpected error: %v", err)
+	}
+	if redelivered := <-source.Messages(); redelivered != msg {
+		t.Fatalf("expected the same message to be redelivered, got %+v", redelivered)
+	}
+	if m.Acked() != 0 {
+		t.Fatalf("expected message to stay unacked while retrying, got %d acks", m.Acked())
+	}
+
+	if err := msg.Nack(StageWrite, errors.New("influx down"), true); err != nil {
+		t.Fatalf("Nack() unexpected error: %v", err)
+	}
+	if len(*published) != 1 || (*published)[0] != "carrot/dead" || m.Acked() != 1 {
+		t.Errorf("expected exhausted message to be dead-lettered and acked, got published=%v acks=%d", *published, m.Acked())
+	}
+}
+
+func TestMqttSource_CancelDropsRedeliveries(t *testing.T) {
+	source, _ := newTestMqttSource(t, MqttConfig{})
+	m := &fakeMqttMessage{topic: "sensors/tlv/t-1000"}
+
+	go source.receive(nil, m)
+	msg := <-source.Messages()
+	msg.Nack(StageWrite, errors.New("influx down"), true)
+
+	source.Close()
+	if _, ok := <-source.Messages(); ok {
+		t.Error("expected messages channel to be closed")
+	}
+	if source.queue.deliver(msg) {
+		t.Error("expected delivery after cancel to be refused")
+	}
+}
+
+func TestMqttSource_Pipeline(t *testing.T) {
+	source, _ := newTestMqttSource(t, MqttConfig{TopicTemplate: "sensors/{site}/{device}"})
+	writeAPI := &fakeWriteAPI{}
+	pipeline := &Pipeline{
+		Source: source,
+		Sink:   NewInfluxSink(writeAPI),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- pipeline.RunContext(ctx)
+	}()
+
+	m := &fakeMqttMessage{topic: "sensors/tlv/t-1000", payload: []byte(`{"device": "override", "metrics": [{"name": "temp", "value": 21.5, "time": "2023-10-15T14:30:45Z"}]}`)}
+	source.receive(nil, m)
+
+	waitFor(t, func() bool { return m.Acked() == 1 })
+	cancel()
+	if err := <-result; err != nil {
+		t.Fatalf("RunContext() returned error: %v", err)
+	}
+
+	points := writeAPI.Points()
+	if len(points) != 1 {
+		t.Fatalf("expected 1 point written, got %d", len(points))
+	}
+
+	tags := make(map[string]string)
+	for _, tag := range points[0].TagList() {
+		tags[tag.Key] = tag.Value
+	}
+	if tags["site"] != "tlv" || tags["device"] != "override" {
+		t.Errorf("expected topic tags under envelope tags, got %v", tags)
+	}
+}
+
+func TestNewMqttSource_Invalid(t *testing.T) {
+	invalid := []MqttConfig{
+		{},
+		{Topics: []string{"sensors/#"}, QoS: 3},
+		{Topics: []string{"sensors/#"}, TopicTemplate: "sensors/#/{device}"},
+	}
+
+	for _, cfg := range invalid {
+		if _, err := newMqttSource(cfg); err == nil {
+			t.Errorf("newMqttSource(%+v) expected error, got nil", cfg)
+		}
+	}
+}
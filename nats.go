@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const defaultNatsDurable = "carrot"
+
+// NatsSource reads metrics from NATS. Core subscriptions are at-most-once:
+// their messages cannot be redelivered, so failures go straight to
+// DeadLetterSubject. JetStream messages are acked once written, redelivered
+// with a backoff on retryable failures and terminated otherwise.
+type NatsSource struct {
+	cfg      NatsConfig
+	conn     *nats.Conn
+	template *TopicTemplate
+	publish  func(msg *nats.Msg) error
+	queue    *messageQueue
+
+	// MessageLog writes the lines about single messages.
+	MessageLog *MessageLog
+
+	subs       []*nats.Subscription
+	consume    jetstream.ConsumeContext
+	cancelOnce sync.Once
+}
+
+func ConsumeNats(cfg NatsConfig) (*NatsSource, error) {
+	source, err := newNatsSource(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []nats.Option{
+		nats.Name(consumerTag),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(conn *nats.Conn, err error) {
+			Log.Warn("Lost connection to nats, reconnecting", "err", err)
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			Log.Info("Reconnected to nats", "url", conn.ConnectedUrl())
+			sourceReconnects.WithLabelValues(SourceNats).Inc()
+		}),
+	}
+
+	if cfg.Username != "" {
+		opts = append(opts, nats.UserInfo(cfg.Username, cfg.Password))
+	}
+
+	if cfg.Token != "" {
+		opts = append(opts, nats.Token(cfg.Token))
+	}
+
+	conn, err := nats.Connect(cfg.Url, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	source.conn = conn
+	source.publish = conn.PublishMsg
+
+	if cfg.Stream == "" {
+		err = source.subscribe()
+	} else {
+		err = source.consumeStream()
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return source, nil
+}
+
+func newNatsSource(cfg NatsConfig) (*NatsSource, error) {
+	if len(cfg.Subjects) == 0 {
+		return nil, errors.New("nats source needs at least one subject")
+	}
+
+	template, err := ParseTopicTemplate(cfg.SubjectTemplate, ".", "*", ">")
+	if err != nil {
+		return nil, err
+	}
+
+	return &NatsSource{
+		cfg:      cfg,
+		template: template,
+		queue:    newMessageQueue(),
+	}, nil
+}
+
+func (s *NatsSource) subscribe() error {
+	for _, subject := range s.cfg.Subjects {
+		sub, err := s.conn.QueueSubscribe(subject, s.cfg.Queue, s.receiveCore)
+		if err != nil {
+			return err
+		}
+		s.subs = append(s.subs, sub)
+	}
+
+	Log.Info("Subscribed to nats subjects", "subjects", s.cfg.Subjects, "queue", s.cfg.Queue)
+	return nil
+}
+
+func (s *NatsSource) consumeStream() error {
+	js, err := jetstream.New(s.conn)
+	if err != nil {
+		return err
+	}
+
+	durable := s.cfg.Durable
+	if durable == "" {
+		durable = defaultNatsDurable
+	}
+
+	consumer, err := js.CreateOrUpdateConsumer(context.Background(), s.cfg.Stream, jetstream.ConsumerConfig{
+		Durable:        durable,
+		FilterSubjects: s.cfg.Subjects,
+		AckPolicy:      jetstream.AckExplicitPolicy,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.consume, err = consumer.Consume(s.receiveStream)
+	if err != nil {
+		return err
+	}
+
+	Log.Info("Consuming nats stream", "stream", s.cfg.Stream, "durable", durable, "subjects", s.cfg.Subjects)
+	return nil
+}
+
+func (s *NatsSource) receiveCore(m *nats.Msg) {
+	msg := s.message(m.Subject, m.Data, m.Header)
+	msg.Raw = m
+	msg.Ack = func() error {
+		return nil
+	}
+	msg.Nack = func(stage string, reason error, retry bool) error {
+		return s.deadLetter(msg, m.Subject, m.Data, m.Header, stage, reason)
+	}
+
+	if !s.queue.deliver(msg) {
+		s.MessageLog.For(msg).Warn("Dropping nats message received after shutdown", "subject", m.Subject)
+	}
+}
+
+func (s *NatsSource) receiveStream(m jetstream.Msg) {
+	msg := s.message(m.Subject(), m.Data(), m.Headers())
+	msg.Raw = m
+	if meta, err := m.Metadata(); err == nil {
+		msg.Timestamp = meta.Timestamp
+	}
+	msg.Ack = m.Ack
+	msg.Nack = func(stage string, reason error, retry bool) error {
+		if retry {
+			if delivered := natsDelivered(m); delivered <= s.maxRetries() {
+				return m.NakWithDelay(backoffDelay(defaultInitialDelay, defaultMaxDelay, delivered))
+			}
+		}
+
+		if s.cfg.DeadLetterSubject == "" {
+			return m.TermWithReason(stage + ": " + reason.Error())
+		}
+
+		if err := s.deadLetter(msg, m.Subject(), m.Data(), m.Headers(), stage, reason); err != nil {
+			return err
+		}
+		return m.Term()
+	}
+
+	// Unless delivered the message is neither acked nor nacked, so the
+	// server redelivers it once its ack wait has passed.
+	s.queue.deliver(msg)
+}
+
+func (s *NatsSource) message(subject string, data []byte, header nats.Header) *Message {
+	headers := make(map[string]any, len(header))
+	for key := range header {
+		headers[key] = header.Get(key)
+	}
+
+	return &Message{
+		Body:            data,
+		ContentType:     header.Get("Content-Type"),
+		ContentEncoding: header.Get("Content-Encoding"),
+		Headers:         headers,
+		MessageID:       header.Get(nats.MsgIdHdr),
+		Tags:            s.template.Tags(subject),
+	}
+}
+
+// deadLetter publishes a copy of the message to DeadLetterSubject with the
+// failure reason in its headers. Without a dead-letter subject it is dropped.
+func (s *NatsSource) deadLetter(msg *Message, subject string, data []byte, header nats.Header, stage string, reason error) error {
+	if s.cfg.DeadLetterSubject == "" {
+		s.MessageLog.For(msg).Warn("Dropping nats message", "subject", subject, "stage", stage, "err", reason)
+		return nil
+	}
+
+	failed := nats.NewMsg(s.cfg.DeadLetterSubject)
+	failed.Data = data
+	for key, values := range header {
+		failed.Header[key] = values
+	}
+	failed.Header.Set(errorHeader, reason.Error())
+	failed.Header.Set(errorStageHeader, stage)
+	failed.Header.Set("x-carrot-subject", subject)
+
+	var validationErr *ValidationError
+	if errors.As(reason, &validationErr) {
+		issues, _ := json.Marshal(validationErr.Issues)
+		failed.Header.Set(validationHeader, string(issues))
+	}
+
+	if err := s.publish(failed); err != nil {
+		return fmt.Errorf("cannot dead-letter nats message: %w", err)
+	}
+
+	return nil
+}
+
+func (s *NatsSource) maxRetries() int {
+	if s.cfg.MaxRetries <= 0 {
+		return defaultMaxRetries
+	}
+
+	return s.cfg.MaxRetries
+}
+
+func (s *NatsSource) Messages() <-chan *Message {
+	return s.queue.messages
+}
+
+func (s *NatsSource) Cancel() error {
+	var errs []error
+	s.cancelOnce.Do(func() {
+		for _, sub := range s.subs {
+			errs = append(errs, sub.Unsubscribe())
+		}
+
+		if s.consume != nil {
+			s.consume.Stop()
+		}
+
+		s.queue.close()
+	})
+
+	return errors.Join(errs...)
+}
+
+func (s *NatsSource) Close() error {
+	err := s.Cancel()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+
+	return err
+}
+
+func (s *NatsSource) HealthChecks() []HealthCheck {
+	return []HealthCheck{{Name: SourceNats, Check: func(ctx context.Context) error {
+		if s.conn == nil {
+			return errors.New("not connected to nats")
+		}
+		if status := s.conn.Status(); status != nats.CONNECTED {
+			return fmt.Errorf("nats connection is %s", status)
+		}
+		return nil
+	}}}
+}
+
+// natsDelivered returns how often m was delivered so far, including this
+// delivery.
+func natsDelivered(m jetstream.Msg) int {
+	meta, err := m.Metadata()
+	if err != nil {
+		return 1
+	}
+
+	return int(meta.NumDelivered)
+}
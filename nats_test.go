@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type fakeJetStreamMsg struct {
+	subject   string
+	data      []byte
+	header    nats.Header
+	delivered uint64
+
+	mu         sync.Mutex
+	acked      int
+	naked      []time.Duration
+	terminated string
+}
+
+func (f *fakeJetStreamMsg) Metadata() (*jetstream.MsgMetadata, error) {
+	return &jetstream.MsgMetadata{NumDelivered: f.delivered}, nil
+}
+
+func (f *fakeJetStreamMsg) Data() []byte                        { return f.data }
+func (f *fakeJetStreamMsg) Headers() nats.Header                { return f.header }
+func (f *fakeJetStreamMsg) Subject() string                     { return f.subject }
+func (f *fakeJetStreamMsg) Reply() string                       { return "" }
+func (f *fakeJetStreamMsg) DoubleAck(ctx context.Context) error { return f.Ack() }
+func (f *fakeJetStreamMsg) Nak() error                          { return f.NakWithDelay(0) }
+func (f *fakeJetStreamMsg) InProgress() error                   { return nil }
+func (f *fakeJetStreamMsg) Term() error                         { return f.TermWithReason("terminated") }
+
+func (f *fakeJetStreamMsg) Ack() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.acked++
+	return nil
+}
+
+func (f *fakeJetStreamMsg) NakWithDelay(delay time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.naked = append(f.naked, delay)
+	return nil
+}
+
+func (f *fakeJetStreamMsg) TermWithReason(reason string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.terminated = reason
+	return nil
+}
+
+func (f *fakeJetStreamMsg) Acked() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.acked
+}
+
+func newTestNatsSource(t *testing.T, cfg NatsConfig) (*NatsSource, *[]*nats.Msg) {
+	t.Helper()
+
+	cfg.Subjects = []string{"metrics.>"}
+	source, err := newNatsSource(cfg)
+	if err != nil {
+		t.Fatalf("newNatsSource() unexpected error: %v", err)
+	}
+
+	var published []*nats.Msg
+	source.publish = func(msg *nats.Msg) error {
+		published = append(published, msg)
+		return nil
+	}
+
+	return source, &published
+}
+
+func TestNatsSource_StreamMessage(t *testing.T) {
+	source, _ := newTestNatsSource(t, NatsConfig{SubjectTemplate: "metrics.{service}.>"})
+	header := nats.Header{}
+	header.Set(nats.MsgIdHdr, "abc")
+	header.Set("Content-Type", "application/json")
+	m := &fakeJetStreamMsg{subject: "metrics.billing.eu", data: []byte(`{}`), header: header, delivered: 1}
+
+	go source.receiveStream(m)
+	msg := <-source.Messages()
+
+	if msg.Tags["service"] != "billing" || msg.MessageID != "abc" || msg.ContentType != "application/json" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	msg.Ack()
+	if m.Acked() != 1 {
+		t.Errorf("expected message to be acked, got %d acks", m.Acked())
+	}
+}
+
+func TestNatsSource_StreamRetry(t *testing.T) {
+	source, published := newTestNatsSource(t, NatsConfig{MaxRetries: 2, DeadLetterSubject: "metrics.dead"})
+
+	retried := &fakeJetStreamMsg{subject: "metrics.cpu", header: nats.Header{}, delivered: 2}
+	go source.receiveStream(retried)
+	msg := <-source.Messages()
+	if err := msg.Nack(StageWrite, errors.New("influx down"), true); err != nil {
+		t.Fatalf("Nack() unexpected error: %v", err)
+	}
+	if len(retried.naked) != 1 || retried.naked[0] <= 0 || retried.terminated != "" {
+		t.Errorf("expected a delayed nak, got naked=%v terminated=%q", retried.naked, retried.terminated)
+	}
+
+	exhausted := &fakeJetStreamMsg{subject: "metrics.cpu", data: []byte("x"), header: nats.Header{}, delivered: 3}
+	go source.receiveStream(exhausted)
+	msg = <-source.Messages()
+	msg.Nack(StageWrite, errors.New("influx down"), true)
+
+	if len(exhausted.naked) != 0 || exhausted.terminated == "" {
+		t.Errorf("expected exhausted message to be terminated, got naked=%v", exhausted.naked)
+	}
+	if len(*published) != 1 {
+		t.Fatalf("expected one dead-lettered message, got %d", len(*published))
+	}
+	dead := (*published)[0]
+	if dead.Subject != "metrics.dead" || dead.Header.Get(errorHeader) != "influx down" || dead.Header.Get(errorStageHeader) != StageWrite {
+		t.Errorf("unexpected dead-letter message %+v", dead)
+	}
+}
+
+func TestNatsSource_StreamTerminatesWithoutDeadLetterSubject(t *testing.T) {
+	source, _ := newTestNatsSource(t, NatsConfig{})
+	m := &fakeJetStreamMsg{subject: "metrics.cpu", header: nats.Header{}, delivered: 1}
+
+	go source.receiveStream(m)
+	msg := <-source.Messages()
+	msg.Nack(StageParse, errors.New("bad json"), false)
+
+	if m.terminated != "parse: bad json" {
+		t.Errorf("expected message to be terminated with its reason, got %q", m.terminated)
+	}
+}
+
+func TestNatsSource_CorePipeline(t *testing.T) {
+	source, published := newTestNatsSource(t, NatsConfig{SubjectTemplate: "metrics.{service}.*", DeadLetterSubject: "metrics.dead"})
+	writeAPI := &fakeWriteAPI{}
+	pipeline := &Pipeline{
+		Source: source,
+		Sink:   NewInfluxSink(writeAPI),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- pipeline.RunContext(ctx)
+	}()
+
+	source.receiveCore(&nats.Msg{Subject: "metrics.billing.cpu", Data: []byte(metricBody("cpu"))})
+	source.receiveCore(&nats.Msg{Subject: "metrics.billing.cpu", Data: []byte(`{invalid json`)})
+
+	waitFor(t, func() bool { return len(writeAPI.Points()) == 1 })
+	cancel()
+	if err := <-result; err != nil {
+		t.Fatalf("RunContext() returned error: %v", err)
+	}
+
+	tags := writeAPI.Points()[0].TagList()
+	if len(tags) != 1 || tags[0].Key != "service" || tags[0].Value != "billing" {
+		t.Errorf("expected service tag from subject, got %v", tags)
+	}
+	if len(*published) != 1 || (*published)[0].Header.Get(errorStageHeader) != StageParse {
+		t.Errorf("expected invalid message to be dead-lettered, got %v", *published)
+	}
+}
+
+func TestNewNatsSource_Invalid(t *testing.T) {
+	invalid := []NatsConfig{
+		{},
+		{Subjects: []string{"metrics.>"}, SubjectTemplate: "metrics.>.{service}"},
+	}
+
+	for _, cfg := range invalid {
+		if _, err := newNatsSource(cfg); err == nil {
+			t.Errorf("newNatsSource(%+v) expected error, got nil", cfg)
+		}
+	}
+}
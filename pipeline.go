@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+var ErrShutdownTimeout = errors.New("shutdown deadline exceeded before in-flight messages drained")
+
+type Pipeline struct {
+	// Name labels the metrics of the pipeline, usually its kind of source.
+	Name                string
+	Source              Source
+	Sink                Sink
+	Batch               BatchConfig
+	Format              string
+	MaxDecompressedSize int64
+	Time                TimeConfig
+	Validator           *Validator
+	MessageLog          *MessageLog
+	ShutdownTimeout     time.Duration
+
+	writer *BatchWriter
+}
+
+// Shutdown starts a single deadline once its context is done, so every stage
+// of a shutdown shares it instead of each getting a timeout of its own.
+type Shutdown struct {
+	ctx     context.Context
+	timeout time.Duration
+
+	once     sync.Once
+	deadline context.Context
+	cancel   context.CancelFunc
+}
+
+// NewShutdown starts the shutdown when ctx is done. A timeout of 0 means
+// defaultShutdownTimeout.
+func NewShutdown(ctx context.Context, timeout time.Duration) *Shutdown {
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	return &Shutdown{ctx: ctx, timeout: timeout}
+}
+
+// NotifyShutdown starts the shutdown on any of signals, SIGTERM/SIGINT when
+// none are given. The handler is installed before it returns. Calling stop
+// releases the signal handler and the deadline.
+func NotifyShutdown(timeout time.Duration, signals ...os.Signal) (shutdown *Shutdown, stop func()) {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGTERM, os.Interrupt}
+	}
+
+	ctx, stopSignal := signal.NotifyContext(context.Background(), signals...)
+	shutdown = NewShutdown(ctx, timeout)
+
+	return shutdown, func() {
+		shutdown.Stop()
+		stopSignal()
+	}
+}
+
+// Done is closed once the shutdown starts.
+func (s *Shutdown) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Deadline returns the context every stage of the shutdown has to finish by.
+// Its timeout starts on the first call.
+func (s *Shutdown) Deadline() context.Context {
+	s.once.Do(func() {
+		s.deadline, s.cancel = context.WithTimeout(context.Background(), s.timeout)
+	})
+
+	return s.deadline
+}
+
+func (s *Shutdown) Stop() {
+	s.Deadline()
+	s.cancel()
+}
+
+// Run processes messages until the source stops or SIGTERM/SIGINT is
+// received, then drains in-flight messages within ShutdownTimeout.
+func (p *Pipeline) Run() error {
+	shutdown, stop := NotifyShutdown(p.ShutdownTimeout)
+	defer stop()
+
+	return RunPipelines(shutdown, p)
+}
+
+// RunPipelines runs every pipeline side by side until the shutdown starts and
+// returns once all of them drained within its deadline. Without any pipelines
+// it just waits for the shutdown.
+func RunPipelines(shutdown *Shutdown, pipelines ...*Pipeline) error {
+	if len(pipelines) == 0 {
+		<-shutdown.Done()
+		return nil
+	}
+
+	errs := make([]error, len(pipelines))
+	var wg sync.WaitGroup
+	for i, p := range pipelines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = p.run(shutdown)
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// RunContext processes messages until ctx is done, then drains in-flight
+// messages within ShutdownTimeout.
+func (p *Pipeline) RunContext(ctx context.Context) error {
+	shutdown := NewShutdown(ctx, p.ShutdownTimeout)
+	defer shutdown.Stop()
+
+	return p.run(shutdown)
+}
+
+func (p *Pipeline) run(shutdown *Shutdown) error {
+	p.writer = NewBatchWriter(p.Sink, p.Batch, p.ack, p.retry)
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for msg := range p.Source.Messages() {
+			if throttler, ok := p.Sink.(Throttler); ok {
+				throttler.Wait(shutdown.ctx)
+			}
+			p.handle(msg)
+		}
+	}()
+
+	select {
+	case <-drained:
+	case <-shutdown.Done():
+		Log.Info("Shutting down, draining in-flight messages", "timeout", shutdown.timeout)
+		if err := p.Source.Cancel(); err != nil {
+			Log.Error("Cannot cancel source", "err", err)
+		}
+	}
+
+	deadline := shutdown.Deadline()
+
+	var err error
+	select {
+	case <-drained:
+		err = p.writer.Close(deadline)
+	case <-deadline.Done():
+		err = ErrShutdownTimeout
+	}
+
+	if flushErr := p.Sink.Flush(deadline); flushErr != nil {
+		err = errors.Join(err, flushErr)
+	}
+
+	return errors.Join(err, p.Source.Close())
+}
+
+// closeWithin closes c, giving up once ctx is done so a hanging close cannot
+// hold the process past its shutdown deadline.
+func closeWithin(ctx context.Context, c io.Closer) error {
+	closed := make(chan error, 1)
+	go func() {
+		closed <- c.Close()
+	}()
+
+	select {
+	case err := <-closed:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Pipeline) handle(msg *Message) {
+	p.MessageLog.Received(msg)
+	messagesReceived.WithLabelValues(p.Name).Inc()
+	if !msg.Timestamp.IsZero() {
+		messageLag.WithLabelValues(p.Name).Observe(time.Since(msg.Timestamp).Seconds())
+	}
+
+	body, err := Decompress(msg.Body, msg.ContentEncoding, p.MaxDecompressedSize)
+	if err != nil {
+		p.MessageLog.For(msg).Error("Cannot decompress msg", "err", err)
+		p.nack(msg, StageParse, err, false)
+		return
+	}
+
+	metric, err := DecodeMessage(body, msg.ContentType, p.Format, p.Time)
+	if err != nil {
+		p.MessageLog.For(msg).Error("Cannot consume msg", "err", err)
+		p.nack(msg, StageParse, err, false)
+		return
+	}
+
+	messagesParsed.WithLabelValues(p.Name).Inc()
+
+	if len(msg.Tags) > 0 {
+		for _, m := range metric {
+			m.Tags = mergeTags(msg.Tags, m.Tags)
+		}
+	}
+
+	if err := p.Validator.Validate(metric); err != nil {
+		p.MessageLog.For(msg).Error("Rejected invalid msg", "err", err)
+		p.nack(msg, StageValidate, err, false)
+		return
+	}
+
+	p.writer.Add(metric, msg)
+}
+
+func (p *Pipeline) ack(msgs []*Message) {
+	ackMessages(p.Source, msgs)
+}
+
+func (p *Pipeline) retry(msg *Message, err error) {
+	p.MessageLog.For(msg).Error("Cannot write metrics", "err", err)
+	p.nack(msg, StageWrite, err, IsRetryable(err))
+}
+
+func (p *Pipeline) nack(msg *Message, stage string, reason error, retry bool) {
+	messagesFailed.WithLabelValues(p.Name, stage).Inc()
+	if err := msg.Nack(stage, reason, retry); err != nil {
+		p.MessageLog.For(msg).Error("Cannot nack msg", "stage", stage, "retry", retry, "err", err)
+	}
+}
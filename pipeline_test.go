@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	http2 "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+func metricBody(name string) string {
+	return fmt.Sprintf(`{"metrics": [{"name": %q, "value": 1, "time": "2023-10-15T14:30:45Z"}]}`, name)
+}
+
+func TestPipeline_ShutdownOnSignal(t *testing.T) {
+	source := NewMemorySource(0)
+	writeAPI := &fakeWriteAPI{}
+	pipeline := &Pipeline{
+		Source:          source,
+		Sink:            NewInfluxSink(writeAPI),
+		ShutdownTimeout: time.Second,
+	}
+
+	// Install the handler before signalling, on a signal nothing else in the
+	// test binary listens for, so the signal can never kill the process.
+	shutdown, stop := NotifyShutdown(pipeline.ShutdownTimeout, syscall.SIGUSR1)
+	defer stop()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- RunPipelines(shutdown, pipeline)
+	}()
+
+	source.Publish([]byte(metricBody("cpu_usage")))
+	source.Publish([]byte(`{invalid json`))
+	source.Publish([]byte(metricBody("mem_usage")))
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatalf("Failed to send SIGUSR1: %v", err)
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("RunPipelines() returned error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("RunPipelines() did not return after the signal")
+	}
+
+	if !source.Closed() {
+		t.Error("expected source to be closed")
+	}
+	outcomes := source.Outcomes()
+	if len(outcomes) != 3 || !outcomes[0].Acked || outcomes[1].Acked || !outcomes[2].Acked {
+		t.Fatalf("expected messages 1 and 3 to be acked, got %+v", outcomes)
+	}
+	if outcomes[1].Stage != StageParse || outcomes[1].Retry {
+		t.Errorf("expected invalid json to be dead-lettered at parse stage, got %+v", outcomes[1])
+	}
+	if len(writeAPI.Points()) != 2 {
+		t.Errorf("expected 2 points written, got %d", len(writeAPI.Points()))
+	}
+	if writeAPI.flushed != 1 {
+		t.Errorf("expected write api to be flushed once, got %d", writeAPI.flushed)
+	}
+}
+
+func TestPipeline_RetriesFailedWrites(t *testing.T) {
+	source := NewMemorySource(0)
+	pipeline := &Pipeline{
+		Source: source,
+		Sink:   NewInfluxSink(&fakeWriteAPI{err: &http2.Error{StatusCode: http.StatusServiceUnavailable}}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- pipeline.RunContext(ctx)
+	}()
+
+	source.Publish([]byte(metricBody("cpu_usage")))
+	cancel()
+
+	if err := <-result; err != nil {
+		t.Fatalf("RunContext() returned error: %v", err)
+	}
+	outcomes := source.Outcomes()
+	if len(outcomes) != 1 || outcomes[0].Acked || !outcomes[0].Retry || outcomes[0].Stage != StageWrite {
+		t.Errorf("expected the message to be retried, got %+v", outcomes)
+	}
+}
+
+func TestPipeline_DeadLettersRejectedWrites(t *testing.T) {
+	source := NewMemorySource(0)
+	pipeline := &Pipeline{
+		Source: source,
+		Sink:   NewInfluxSink(&fakeWriteAPI{err: &http2.Error{StatusCode: http.StatusBadRequest, Message: "bad line protocol"}}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- pipeline.RunContext(ctx)
+	}()
+
+	source.Publish([]byte(metricBody("cpu_usage")))
+	cancel()
+
+	if err := <-result; err != nil {
+		t.Fatalf("RunContext() returned error: %v", err)
+	}
+	outcomes := source.Outcomes()
+	if len(outcomes) != 1 || outcomes[0].Acked || outcomes[0].Retry || outcomes[0].Stage != StageWrite {
+		t.Errorf("expected rejected write to be dead-lettered, got %+v", outcomes)
+	}
+}
+
+func TestPipeline_DeadLettersInvalidMessages(t *testing.T) {
+	validator, err := NewValidator(ValidationConfig{Strict: true})
+	if err != nil {
+		t.Fatalf("NewValidator() unexpected error: %v", err)
+	}
+
+	source := NewMemorySource(0)
+	writeAPI := &fakeWriteAPI{}
+	pipeline := &Pipeline{
+		Source:    source,
+		Sink:      NewInfluxSink(writeAPI),
+		Validator: validator,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- pipeline.RunContext(ctx)
+	}()
+
+	source.Publish([]byte(`{"metrics": [{"name": "cpu", "value": {"nested": 1}, "time": "2023-10-15T14:30:45Z"}]}`))
+	source.Publish([]byte(metricBody("cpu_usage")))
+	cancel()
+
+	if err := <-result; err != nil {
+		t.Fatalf("RunContext() returned error: %v", err)
+	}
+	outcomes := source.Outcomes()
+	if len(outcomes) != 2 || outcomes[0].Stage != StageValidate || !outcomes[1].Acked {
+		t.Errorf("expected only the invalid message to be dead-lettered, got %+v", outcomes)
+	}
+	if len(writeAPI.Points()) != 1 {
+		t.Errorf("expected only the valid metric to be written, got %d points", len(writeAPI.Points()))
+	}
+}
+
+func TestPipeline_DeadLettersEmptyBatchesWithoutStrictValidation(t *testing.T) {
+	source := NewMemorySource(0)
+	pipeline := &Pipeline{
+		Source: source,
+		Sink:   NewInfluxSink(&fakeWriteAPI{}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- pipeline.RunContext(ctx)
+	}()
+
+	source.Publish([]byte(`{"metrics": []}`))
+	cancel()
+
+	if err := <-result; err != nil {
+		t.Fatalf("RunContext() returned error: %v", err)
+	}
+	outcomes := source.Outcomes()
+	if len(outcomes) != 1 || outcomes[0].Acked || outcomes[0].Stage != StageValidate {
+		t.Errorf("expected empty batch to be dead-lettered, got %+v", outcomes)
+	}
+}
+
+type blockingWriteAPI struct {
+	fakeWriteAPI
+	release chan struct{}
+}
+
+func (b *blockingWriteAPI) WritePoint(ctx context.Context, point ...*write.Point) error {
+	<-b.release
+	return nil
+}
+
+func TestPipeline_ShutdownDeadline(t *testing.T) {
+	source := NewMemorySource(0)
+	writeAPI := &blockingWriteAPI{release: make(chan struct{})}
+	defer close(writeAPI.release)
+
+	pipeline := &Pipeline{
+		Source:          source,
+		Sink:            NewInfluxSink(writeAPI),
+		ShutdownTimeout: 50 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- pipeline.RunContext(ctx)
+	}()
+
+	source.Publish([]byte(metricBody("cpu_usage")))
+	cancel()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrShutdownTimeout) {
+			t.Fatalf("expected ErrShutdownTimeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RunContext() did not honour the shutdown deadline")
+	}
+	if !source.Closed() {
+		t.Error("expected source to be closed after deadline")
+	}
+}
+
+func TestRunPipelines_SharesShutdownDeadline(t *testing.T) {
+	source := NewMemorySource(0)
+	writeAPI := &blockingWriteAPI{release: make(chan struct{})}
+	defer close(writeAPI.release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	shutdown := NewShutdown(ctx, 300*time.Millisecond)
+	defer shutdown.Stop()
+
+	pipeline := &Pipeline{Source: source, Sink: NewInfluxSink(writeAPI)}
+	result := make(chan error, 1)
+	go func() {
+		result <- RunPipelines(shutdown, pipeline)
+	}()
+	source.Publish([]byte(metricBody("cpu_usage")))
+
+	// An earlier stage, such as stopping the api, used most of the deadline.
+	deadline := shutdown.Deadline()
+	time.Sleep(250 * time.Millisecond)
+	if shutdown.Deadline() != deadline {
+		t.Fatal("expected every stage to get the same deadline")
+	}
+
+	start := time.Now()
+	cancel()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrShutdownTimeout) {
+			t.Fatalf("expected ErrShutdownTimeout, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+			t.Errorf("expected pipelines to get only the rest of the deadline, took %v", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RunPipelines() did not honour the shared deadline")
+	}
+}
+
+type blockingCloser struct {
+	release chan struct{}
+}
+
+func (c *blockingCloser) Close() error {
+	<-c.release
+	return nil
+}
+
+func TestCloseWithin(t *testing.T) {
+	closer := &blockingCloser{release: make(chan struct{})}
+	defer close(closer.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := closeWithin(ctx, closer); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected close to give up at the deadline, got %v", err)
+	}
+
+	if err := closeWithin(context.Background(), &fakeSink{}); err != nil {
+		t.Errorf("closeWithin() unexpected error: %v", err)
+	}
+}
+
+func TestPipeline_LineProtocolByContentType(t *testing.T) {
+	source := NewMemorySource(0)
+	writeAPI := &fakeWriteAPI{}
+	pipeline := &Pipeline{
+		Source: source,
+		Sink:   NewInfluxSink(writeAPI),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- pipeline.RunContext(ctx)
+	}()
+
+	source.PublishMessage(&Message{
+		Body:        []byte("cpu,host=server1 user=12.5,system=3.1 1697380245000000000"),
+		ContentType: "application/x-influx-line-protocol",
+		Tags:        map[string]string{"site": "edge"},
+	})
+	source.Publish([]byte(metricBody("mem_usage")))
+	cancel()
+
+	if err := <-result; err != nil {
+		t.Fatalf("RunContext() returned error: %v", err)
+	}
+	outcomes := source.Outcomes()
+	if len(outcomes) != 2 || !outcomes[0].Acked || !outcomes[1].Acked {
+		t.Fatalf("expected both messages to be acked, got %+v", outcomes)
+	}
+
+	points := writeAPI.Points()
+	if len(points) != 2 {
+		t.Fatalf("expected 2 points written, got %d", len(points))
+	}
+	if len(points[0].FieldList()) != 2 || len(points[0].TagList()) != 2 {
+		t.Errorf("expected line protocol fields and source tags to be kept, got %+v", points[0])
+	}
+}
+
+func TestPipeline_DecompressesBodies(t *testing.T) {
+	source := NewMemorySource(0)
+	writeAPI := &fakeWriteAPI{}
+	pipeline := &Pipeline{
+		Source:              source,
+		Sink:                NewInfluxSink(writeAPI),
+		MaxDecompressedSize: 1024,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- pipeline.RunContext(ctx)
+	}()
+
+	source.PublishMessage(&Message{Body: compress(t, "zstd", []byte(metricBody("cpu"))), ContentEncoding: "zstd"})
+	source.PublishMessage(&Message{Body: compress(t, "gzip", make([]byte, 2048)), ContentEncoding: "gzip"})
+	cancel()
+
+	if err := <-result; err != nil {
+		t.Fatalf("RunContext() returned error: %v", err)
+	}
+	outcomes := source.Outcomes()
+	if len(outcomes) != 2 || !outcomes[0].Acked {
+		t.Fatalf("expected compressed message to be acked, got %+v", outcomes)
+	}
+	if outcomes[1].Acked || outcomes[1].Retry || outcomes[1].Stage != StageParse {
+		t.Errorf("expected oversized body to be dead-lettered at parse stage, got %+v", outcomes[1])
+	}
+	if len(writeAPI.Points()) != 1 {
+		t.Errorf("expected 1 point written, got %d", len(writeAPI.Points()))
+	}
+}
@@ -1,19 +1,296 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/streadway/amqp"
 )
 
-func ConsumeMessages(cfg *Config) (<-chan amqp.Delivery, error) {
-	conn, err := amqp.Dial(fmt.Sprintf("amqp://%s:%s@%s:%d/", 
-		cfg.Rabbit.Username,
-		cfg.Rabbit.Password,
-		cfg.Rabbit.Host,
-		cfg.Rabbit.Port,
-	))
+var consumerTag = fmt.Sprintf("carrot-%d", os.Getpid())
 
+const (
+	defaultReconnectDelay    = time.Second
+	defaultMaxReconnectDelay = 30 * time.Second
+)
+
+type rabbitSession struct {
+	conn       *amqp.Connection
+	ch         *amqp.Channel
+	queue      string
+	retryQueue string
+	msgs       <-chan amqp.Delivery
+	connClosed chan *amqp.Error
+	chClosed   chan *amqp.Error
+
+	// publishMu keeps a single publish in flight, so the next confirmation
+	// always belongs to it.
+	publishMu sync.Mutex
+	confirms  chan amqp.Confirmation
+}
+
+type RabbitConsumer struct {
+	cfg        *Config
+	messages   chan *Message
+	done       chan struct{}
+	cancelOnce sync.Once
+
+	mu      sync.Mutex
+	session *rabbitSession
+	// consuming is cleared while the channel of the session is closed.
+	consuming atomic.Bool
+}
+
+func ConsumeMessages(cfg *Config) (*RabbitConsumer, error) {
+	session, err := connectRabbit(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	consumer := &RabbitConsumer{
+		cfg:      cfg,
+		messages: make(chan *Message),
+		done:     make(chan struct{}),
+		session:  session,
+	}
+	consumer.consuming.Store(true)
+
+	go consumer.supervise()
+
+	return consumer, nil
+}
+
+func (c *RabbitConsumer) Messages() <-chan *Message {
+	return c.messages
+}
+
+// message wraps a delivery so failures go through the retry and dead-letter
+// handling of the consumer.
+func (c *RabbitConsumer) message(d amqp.Delivery) *Message {
+	return &Message{
+		Body:            d.Body,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		Headers:         d.Headers,
+		MessageID:       d.MessageId,
+		CorrelationID:   d.CorrelationId,
+		Timestamp:       d.Timestamp,
+		Raw:             d,
+		Ack: func() error {
+			return d.Ack(false)
+		},
+		Nack: func(stage string, reason error, retry bool) error {
+			if retry {
+				return c.Retry(d, stage, reason)
+			}
+			return c.DeadLetter(d, stage, reason)
+		},
+	}
+}
+
+// AckBatch acks every message with one multiple-ack per channel, using the
+// highest delivery tag seen on that channel.
+func (c *RabbitConsumer) AckBatch(msgs []*Message) error {
+	last := make(map[amqp.Acknowledger]amqp.Delivery)
+	var order []amqp.Acknowledger
+	var errs []error
+
+	for _, msg := range msgs {
+		d, ok := msg.Raw.(amqp.Delivery)
+		if !ok {
+			errs = append(errs, msg.Ack())
+			continue
+		}
+
+		prev, seen := last[d.Acknowledger]
+		if !seen {
+			order = append(order, d.Acknowledger)
+		}
+
+		if !seen || d.DeliveryTag > prev.DeliveryTag {
+			last[d.Acknowledger] = d
+		}
+	}
+
+	for _, acknowledger := range order {
+		errs = append(errs, last[acknowledger].Ack(true))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *RabbitConsumer) HealthChecks() []HealthCheck {
+	return []HealthCheck{{Name: SourceRabbit, Check: c.checkChannel}}
+}
+
+func (c *RabbitConsumer) checkChannel(ctx context.Context) error {
+	if c.currentSession().conn.IsClosed() {
+		return errors.New("amqp connection is closed")
+	}
+
+	if !c.consuming.Load() {
+		return errors.New("amqp channel is closed")
+	}
+
+	return nil
+}
+
+func (c *RabbitConsumer) currentSession() *rabbitSession {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.session
+}
+
+// Cancel stops consuming. Deliveries already received from the broker are
+// still handed out before the Messages channel is closed.
+func (c *RabbitConsumer) Cancel() error {
+	var err error
+	c.cancelOnce.Do(func() {
+		close(c.done)
+		err = c.currentSession().ch.Cancel(consumerTag, false)
+	})
+
+	return err
+}
+
+func (c *RabbitConsumer) Close() error {
+	c.Cancel()
+	return c.currentSession().conn.Close()
+}
+
+func (c *RabbitConsumer) cancelled() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// supervise forwards deliveries and transparently reconnects whenever the
+// broker closes the connection or the channel.
+func (c *RabbitConsumer) supervise() {
+	defer close(c.messages)
+
+	session := c.currentSession()
+	for {
+		for msg := range session.msgs {
+			c.messages <- c.message(msg)
+		}
+		c.consuming.Store(false)
+
+		if c.cancelled() {
+			return
+		}
+
+		var reason *amqp.Error
+		select {
+		case reason = <-session.connClosed:
+		case reason = <-session.chClosed:
+		case <-c.done:
+			return
+		}
+		session.conn.Close()
+
+		var err error = amqp.ErrClosed
+		if reason != nil {
+			err = reason
+		}
+
+		session = reconnectRabbit(c.cfg, err, c.done)
+		if session == nil {
+			return
+		}
+
+		c.mu.Lock()
+		c.session = session
+		c.mu.Unlock()
+		c.consuming.Store(true)
+
+		if c.cancelled() {
+			session.ch.Cancel(consumerTag, false)
+		}
+	}
+}
+
+// reconnectRabbit retries until a new session is established, or returns nil
+// once done is closed.
+func reconnectRabbit(cfg *Config, reason error, done <-chan struct{}) *rabbitSession {
+	for attempt := 1; ; attempt++ {
+		delay := reconnectDelay(cfg.Rabbit, attempt)
+		Log.Warn("Lost connection to rabbitmq, reconnecting", "attempt", attempt, "delay", delay, "err", reason)
+
+		select {
+		case <-time.After(delay):
+		case <-done:
+			return nil
+		}
+
+		session, err := connectRabbit(cfg)
+		if err != nil {
+			reason = err
+			continue
+		}
+
+		Log.Info("Reconnected to rabbitmq", "attempt", attempt)
+		sourceReconnects.WithLabelValues(SourceRabbit).Inc()
+		return session
+	}
+}
+
+func reconnectDelay(cfg RabbitConfig, attempt int) time.Duration {
+	base := cfg.ReconnectDelay
+	if base <= 0 {
+		base = defaultReconnectDelay
+	}
+
+	max := cfg.MaxReconnectDelay
+	if max <= 0 {
+		max = defaultMaxReconnectDelay
+	}
+
+	return backoffDelay(base, max, attempt)
+}
+
+func connectRabbit(cfg *Config) (*rabbitSession, error) {
+	conn, err := amqp.Dial(rabbitURL(cfg.Rabbit))
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := setupRabbit(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// rabbitURL escapes the credentials, which often come from secrets with
+// characters such as '@', '/' or '#' in them.
+func rabbitURL(cfg RabbitConfig) string {
+	u := url.URL{
+		Scheme: "amqp",
+		User:   url.UserPassword(cfg.Username, cfg.Password),
+		Host:   net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		Path:   "/",
+	}
+
+	return u.String()
+}
+
+func setupRabbit(conn *amqp.Connection, cfg *Config) (*rabbitSession, error) {
+	exchangeType, err := rabbitExchangeType(cfg.Rabbit.ExchangeType)
 	if err != nil {
 		return nil, err
 	}
@@ -23,11 +300,21 @@ func ConsumeMessages(cfg *Config) (<-chan amqp.Delivery, error) {
 		return nil, err
 	}
 
+	if err := ch.Confirm(false); err != nil {
+		return nil, err
+	}
+
+	if cfg.Rabbit.Prefetch > 0 {
+		if err := ch.Qos(cfg.Rabbit.Prefetch, 0, false); err != nil {
+			return nil, err
+		}
+	}
+
 	exchangeName := cfg.Rabbit.Channel
 	err = ch.ExchangeDeclare(
 		exchangeName,
-		"fanout",
-		false,
+		exchangeType,
+		cfg.Rabbit.ExchangeDurable,
 		false,
 		false,
 		false,
@@ -38,34 +325,46 @@ func ConsumeMessages(cfg *Config) (<-chan amqp.Delivery, error) {
 		return nil, err
 	}
 
+	queue := declaredQueue(cfg.Rabbit.Queue)
 	q, err := ch.QueueDeclare(
-		"",
-		true,
-		false,
+		queue.Name,
+		queue.Durable,
+		queue.AutoDelete,
+		queue.Exclusive,
 		false,
-		false,
-		nil,
+		queueArguments(queue),
 	)
 
 	if err != nil {
 		return nil, err
 	}
 
-	err = ch.QueueBind(
-		q.Name,
-		"",
-		exchangeName,
-		false,
-		nil,
-	)
+	for _, key := range bindingKeys(cfg.Rabbit, exchangeType) {
+		err = ch.QueueBind(
+			q.Name,
+			key,
+			exchangeName,
+			false,
+			rabbitTable(cfg.Rabbit.BindArguments),
+		)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := declareDeadLetter(ch, cfg.Rabbit.DeadLetter); err != nil {
+		return nil, err
+	}
 
+	retryQueue, err := declareRetryQueue(ch, q.Name, queue)
 	if err != nil {
 		return nil, err
 	}
 
 	msgs, err := ch.Consume(
 		q.Name,
-		"",
+		consumerTag,
 		false,
 		false,
 		false,
@@ -77,6 +376,104 @@ func ConsumeMessages(cfg *Config) (<-chan amqp.Delivery, error) {
 		return nil, err
 	}
 
-	return msgs, nil
+	return &rabbitSession{
+		conn:       conn,
+		ch:         ch,
+		queue:      q.Name,
+		retryQueue: retryQueue,
+		msgs:       msgs,
+		connClosed: conn.NotifyClose(make(chan *amqp.Error, 1)),
+		chClosed:   ch.NotifyClose(make(chan *amqp.Error, 1)),
+		confirms:   ch.NotifyPublish(make(chan amqp.Confirmation, 1)),
+	}, nil
+}
+
+func rabbitExchangeType(kind string) (string, error) {
+	switch kind {
+	case "":
+		return amqp.ExchangeFanout, nil
+	case amqp.ExchangeFanout, amqp.ExchangeDirect, amqp.ExchangeTopic, amqp.ExchangeHeaders:
+		return kind, nil
+	default:
+		return "", fmt.Errorf("unsupported exchange type: %s", kind)
+	}
+}
+
+// bindingKeys returns the routing keys the queue is bound with. Fanout and
+// headers exchanges ignore routing keys, so they get a single binding.
+func bindingKeys(cfg RabbitConfig, exchangeType string) []string {
+	if len(cfg.RoutingKeys) == 0 || exchangeType == amqp.ExchangeFanout || exchangeType == amqp.ExchangeHeaders {
+		return []string{""}
+	}
+
+	return cfg.RoutingKeys
+}
+
+// declaredQueue returns the queue as it is declared. A server-named queue is
+// declared anew on every reconnect, so it is made exclusive and auto-deleted
+// rather than left bound to the exchange, filling up with nobody consuming.
+func declaredQueue(cfg QueueConfig) QueueConfig {
+	if cfg.Name == "" {
+		cfg.Durable = false
+		cfg.AutoDelete = true
+		cfg.Exclusive = true
+	}
+
+	return cfg
+}
+
+func queueArguments(cfg QueueConfig) amqp.Table {
+	args := rabbitTable(cfg.Arguments)
+	if args == nil {
+		args = amqp.Table{}
+	}
+
+	if cfg.Type != "" {
+		args["x-queue-type"] = cfg.Type
+	}
+
+	if cfg.MessageTTL > 0 {
+		args["x-message-ttl"] = cfg.MessageTTL.Milliseconds()
+	}
+
+	if cfg.MaxLength > 0 {
+		args["x-max-length"] = int64(cfg.MaxLength)
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	return args
+}
+
+// rabbitTable converts YAML decoded values into types amqp.Table accepts.
+func rabbitTable(values map[string]any) amqp.Table {
+	if len(values) == 0 {
+		return nil
+	}
+
+	table := amqp.Table{}
+	for k, v := range values {
+		table[k] = rabbitValue(v)
+	}
+
+	return table
+}
+
+func rabbitValue(v any) any {
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case map[string]any:
+		return rabbitTable(v)
+	case []any:
+		values := make([]any, len(v))
+		for i, item := range v {
+			values[i] = rabbitValue(item)
+		}
+		return values
+	default:
+		return v
+	}
 }
-	
@@ -1,12 +1,26 @@
 package main
 
 import (
-	"fmt"
+	"errors"
+	"net"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/streadway/amqp"
 )
 
+// skipWithoutRabbit skips tests that need a broker on cfg's address.
+func skipWithoutRabbit(t *testing.T, cfg *Config) {
+	t.Helper()
+
+	conn, err := amqp.Dial(rabbitURL(cfg.Rabbit))
+	if err != nil {
+		t.Skipf("Skipping test because connection failed: %v", err)
+	}
+	conn.Close()
+}
+
 func TestConsumeMessages_Success(t *testing.T) {
 	cfg := &Config{}
 	cfg.Rabbit.Username = "guest"
@@ -14,12 +28,15 @@ func TestConsumeMessages_Success(t *testing.T) {
 	cfg.Rabbit.Host = "localhost"
 	cfg.Rabbit.Port = 5672
 	cfg.Rabbit.Channel = "test-exchange"
+	skipWithoutRabbit(t, cfg)
 
-	msgs, err := ConsumeMessages(cfg)
+	consumer, err := ConsumeMessages(cfg)
 	if err != nil {
 		t.Fatalf("expected success, got error: %v", err)
 	}
-	if msgs == nil {
+	defer consumer.Close()
+
+	if consumer.Messages() == nil {
 		t.Fatal("expected msgs channel, got nil")
 	}
 }
@@ -49,12 +66,7 @@ func TestConsumeMessages_ChannelError(t *testing.T) {
 	cfg.Rabbit.Port = 5672
 	cfg.Rabbit.Channel = "test-exchange"
 
-	conn, err := amqp.Dial(fmt.Sprintf("amqp://%s:%s@%s:%d/",
-		cfg.Rabbit.Username,
-		cfg.Rabbit.Password,
-		cfg.Rabbit.Host,
-		cfg.Rabbit.Port,
-	))
+	conn, err := amqp.Dial(rabbitURL(cfg.Rabbit))
 	if err != nil {
 		t.Skipf("Skipping test because connection failed: %v", err)
 	}
@@ -85,12 +97,7 @@ func TestConsumeMessages_ExchangeDeclareError(t *testing.T) {
 	// Use invalid exchange type to cause exchange declare error
 	cfg.Rabbit.Channel = "test-exchange"
 
-	conn, err := amqp.Dial(fmt.Sprintf("amqp://%s:%s@%s:%d/",
-		cfg.Rabbit.Username,
-		cfg.Rabbit.Password,
-		cfg.Rabbit.Host,
-		cfg.Rabbit.Port,
-	))
+	conn, err := amqp.Dial(rabbitURL(cfg.Rabbit))
 	if err != nil {
 		t.Skipf("Skipping test because connection failed: %v", err)
 	}
@@ -123,12 +130,7 @@ func TestConsumeMessages_QueueDeclareError(t *testing.T) {
 	cfg.Rabbit.Port = 5672
 	cfg.Rabbit.Channel = "test-exchange"
 
-	conn, err := amqp.Dial(fmt.Sprintf("amqp://%s:%s@%s:%d/",
-		cfg.Rabbit.Username,
-		cfg.Rabbit.Password,
-		cfg.Rabbit.Host,
-		cfg.Rabbit.Port,
-	))
+	conn, err := amqp.Dial(rabbitURL(cfg.Rabbit))
 	if err != nil {
 		t.Skipf("Skipping test because connection failed: %v", err)
 	}
@@ -160,12 +162,7 @@ func TestConsumeMessages_QueueBindError(t *testing.T) {
 	cfg.Rabbit.Port = 5672
 	cfg.Rabbit.Channel = "test-exchange"
 
-	conn, err := amqp.Dial(fmt.Sprintf("amqp://%s:%s@%s:%d/",
-		cfg.Rabbit.Username,
-		cfg.Rabbit.Password,
-		cfg.Rabbit.Host,
-		cfg.Rabbit.Port,
-	))
+	conn, err := amqp.Dial(rabbitURL(cfg.Rabbit))
 	if err != nil {
 		t.Skipf("Skipping test because connection failed: %v", err)
 	}
@@ -196,12 +193,7 @@ func TestConsumeMessages_ConsumeError(t *testing.T) {
 	cfg.Rabbit.Port = 5672
 	cfg.Rabbit.Channel = "test-exchange"
 
-	conn, err := amqp.Dial(fmt.Sprintf("amqp://%s:%s@%s:%d/",
-		cfg.Rabbit.Username,
-		cfg.Rabbit.Password,
-		cfg.Rabbit.Host,
-		cfg.Rabbit.Port,
-	))
+	conn, err := amqp.Dial(rabbitURL(cfg.Rabbit))
 	if err != nil {
 		t.Skipf("Skipping test because connection failed: %v", err)
 	}
@@ -225,3 +217,256 @@ func TestConsumeMessages_ConsumeError(t *testing.T) {
 		t.Skip("expected consume error but got nil (RabbitMQ may allow this)")
 	}
 }
+
+func TestRabbitConsumer_Message(t *testing.T) {
+	ack := &fakeAcknowledger{}
+	consumer := &RabbitConsumer{cfg: &Config{}}
+	msg := consumer.message(amqp.Delivery{
+		Acknowledger:  ack,
+		DeliveryTag:   3,
+		Body:          []byte(`{}`),
+		ContentType:   "application/json",
+		MessageId:     "msg-1",
+		CorrelationId: "req-1",
+	})
+
+	if string(msg.Body) != `{}` || msg.ContentType != "application/json" || msg.MessageID != "msg-1" || msg.CorrelationID != "req-1" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	if err := msg.Ack(); err != nil {
+		t.Fatalf("Ack() unexpected error: %v", err)
+	}
+	if err := msg.Nack(StageParse, errors.New("bad json"), false); err != nil {
+		t.Fatalf("Nack() unexpected error: %v", err)
+	}
+
+	if len(ack.acked) != 1 || ack.acked[0] != 3 {
+		t.Errorf("expected delivery 3 to be acked, got %v", ack.acked)
+	}
+	if len(ack.rejected) != 1 || ack.requeued {
+		t.Errorf("expected dead-lettering nack to reject without requeue, got %+v", ack)
+	}
+}
+
+type multiAck struct {
+	tag      uint64
+	multiple bool
+}
+
+type recordingAcknowledger struct {
+	fakeAcknowledger
+	acks []multiAck
+}
+
+func (r *recordingAcknowledger) Ack(tag uint64, multiple bool) error {
+	r.acks = append(r.acks, multiAck{tag: tag, multiple: multiple})
+	return nil
+}
+
+func TestRabbitConsumer_AckBatch(t *testing.T) {
+	first := &recordingAcknowledger{}
+	second := &recordingAcknowledger{}
+	consumer := &RabbitConsumer{cfg: &Config{}}
+
+	msgs := []*Message{
+		consumer.message(amqp.Delivery{Acknowledger: first, DeliveryTag: 5}),
+		consumer.message(amqp.Delivery{Acknowledger: first, DeliveryTag: 6}),
+		consumer.message(amqp.Delivery{Acknowledger: second, DeliveryTag: 1}),
+		consumer.message(amqp.Delivery{Acknowledger: second, DeliveryTag: 2}),
+	}
+
+	if err := consumer.AckBatch(msgs); err != nil {
+		t.Fatalf("AckBatch() unexpected error: %v", err)
+	}
+
+	if acks := first.acks; len(acks) != 1 || acks[0] != (multiAck{tag: 6, multiple: true}) {
+		t.Errorf("expected single multiple-ack of tag 6 on first channel, got %+v", acks)
+	}
+	if acks := second.acks; len(acks) != 1 || acks[0] != (multiAck{tag: 2, multiple: true}) {
+		t.Errorf("expected single multiple-ack of tag 2 on second channel, got %+v", acks)
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	cfg := RabbitConfig{
+		ReconnectDelay:    100 * time.Millisecond,
+		MaxReconnectDelay: time.Second,
+	}
+
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 1, max: 100 * time.Millisecond},
+		{attempt: 2, max: 200 * time.Millisecond},
+		{attempt: 3, max: 400 * time.Millisecond},
+		{attempt: 4, max: 800 * time.Millisecond},
+		{attempt: 5, max: time.Second},
+		{attempt: 50, max: time.Second},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			delay := reconnectDelay(cfg, tt.attempt)
+			if delay < tt.max/2 || delay > tt.max {
+				t.Fatalf("attempt %d: delay %v outside [%v, %v]", tt.attempt, delay, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+func TestReconnectDelay_Defaults(t *testing.T) {
+	delay := reconnectDelay(RabbitConfig{}, 1)
+	if delay < defaultReconnectDelay/2 || delay > defaultReconnectDelay {
+		t.Fatalf("expected default delay around %v, got %v", defaultReconnectDelay, delay)
+	}
+
+	delay = reconnectDelay(RabbitConfig{}, 100)
+	if delay > defaultMaxReconnectDelay {
+		t.Fatalf("expected delay capped at %v, got %v", defaultMaxReconnectDelay, delay)
+	}
+}
+
+func TestRabbitExchangeType(t *testing.T) {
+	tests := []struct {
+		input       string
+		expected    string
+		expectError bool
+	}{
+		{input: "", expected: amqp.ExchangeFanout},
+		{input: "fanout", expected: amqp.ExchangeFanout},
+		{input: "direct", expected: amqp.ExchangeDirect},
+		{input: "topic", expected: amqp.ExchangeTopic},
+		{input: "headers", expected: amqp.ExchangeHeaders},
+		{input: "x-delayed-message", expectError: true},
+	}
+
+	for _, tt := range tests {
+		kind, err := rabbitExchangeType(tt.input)
+		if tt.expectError {
+			if err == nil {
+				t.Errorf("rabbitExchangeType(%q) expected error but got none", tt.input)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("rabbitExchangeType(%q) unexpected error: %v", tt.input, err)
+		}
+		if kind != tt.expected {
+			t.Errorf("rabbitExchangeType(%q) = %q, expected %q", tt.input, kind, tt.expected)
+		}
+	}
+}
+
+func TestBindingKeys(t *testing.T) {
+	cfg := RabbitConfig{RoutingKeys: []string{"cpu.*", "mem.*"}}
+
+	if keys := bindingKeys(cfg, amqp.ExchangeTopic); !reflect.DeepEqual(keys, cfg.RoutingKeys) {
+		t.Errorf("expected topic binding keys %v, got %v", cfg.RoutingKeys, keys)
+	}
+	if keys := bindingKeys(cfg, amqp.ExchangeFanout); !reflect.DeepEqual(keys, []string{""}) {
+		t.Errorf("expected single empty fanout binding key, got %v", keys)
+	}
+	if keys := bindingKeys(RabbitConfig{}, amqp.ExchangeDirect); !reflect.DeepEqual(keys, []string{""}) {
+		t.Errorf("expected single empty binding key without routing keys, got %v", keys)
+	}
+}
+
+func TestDeclaredQueue(t *testing.T) {
+	anonymous := declaredQueue(QueueConfig{Durable: true})
+	if anonymous.Durable || !anonymous.AutoDelete || !anonymous.Exclusive {
+		t.Errorf("expected server-named queue to be exclusive and auto-deleted, got %+v", anonymous)
+	}
+
+	named := QueueConfig{Name: "carrot", Durable: true}
+	if queue := declaredQueue(named); !reflect.DeepEqual(queue, named) {
+		t.Errorf("expected named queue to be declared as configured, got %+v", queue)
+	}
+}
+
+func TestQueueArguments(t *testing.T) {
+	if args := queueArguments(QueueConfig{}); args != nil {
+		t.Errorf("expected nil arguments for default queue, got %v", args)
+	}
+
+	args := queueArguments(QueueConfig{
+		Type:       "quorum",
+		MessageTTL: time.Minute,
+		MaxLength:  500,
+		Arguments: map[string]any{
+			"x-overflow":             "reject-publish",
+			"x-delivery-limit":       5,
+			"x-single-active-nested": map[string]any{"enabled": true},
+		},
+	})
+
+	expected := amqp.Table{
+		"x-queue-type":           "quorum",
+		"x-message-ttl":          int64(60000),
+		"x-max-length":           int64(500),
+		"x-overflow":             "reject-publish",
+		"x-delivery-limit":       int64(5),
+		"x-single-active-nested": amqp.Table{"enabled": true},
+	}
+
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("queueArguments() = %v, expected %v", args, expected)
+	}
+	if err := args.Validate(); err != nil {
+		t.Errorf("queueArguments() produced invalid table: %v", err)
+	}
+}
+
+func TestRabbitURL_EscapesCredentials(t *testing.T) {
+	for _, password := range []string{"p#ss: word", "a/b@c", "50%?off"} {
+		t.Run(password, func(t *testing.T) {
+			cfg := RabbitConfig{Username: "carrot@ops", Password: password, Host: "localhost", Port: 5672}
+
+			uri, err := amqp.ParseURI(rabbitURL(cfg))
+			if err != nil {
+				t.Fatalf("ParseURI() unexpected error: %v", err)
+			}
+			if uri.Username != cfg.Username || uri.Password != password {
+				t.Errorf("expected credentials %q/%q, got %q/%q", cfg.Username, password, uri.Username, uri.Password)
+			}
+			if uri.Host != "localhost" || uri.Port != 5672 || uri.Vhost != "/" {
+				t.Errorf("expected localhost:5672 vhost /, got %s:%d vhost %s", uri.Host, uri.Port, uri.Vhost)
+			}
+		})
+	}
+}
+
+func TestRabbitURL_DialsWithEscapedPassword(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		close(accepted)
+		conn.Close()
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	cfg := RabbitConfig{Username: "guest", Password: "a/b@c p#ss", Host: addr.IP.String(), Port: addr.Port}
+
+	// The listener is not a broker, so the handshake fails once the URL
+	// has been parsed and the address dialed.
+	if _, err := amqp.Dial(rabbitURL(cfg)); err == nil {
+		t.Fatal("expected handshake error but got none")
+	}
+
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("expected amqp.Dial to reach the configured address")
+	}
+}
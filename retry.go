@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	http2 "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+const (
+	defaultMaxAttempts  = 3
+	defaultInitialDelay = 500 * time.Millisecond
+	defaultMaxDelay     = 10 * time.Second
+)
+
+// ResilientWriteAPI retries retryable InfluxDB write errors with exponential
+// backoff and refuses writes while its circuit breaker is open.
+type ResilientWriteAPI struct {
+	api.WriteAPIBlocking
+	retry   RetryConfig
+	breaker *CircuitBreaker
+}
+
+func NewResilientWriteAPI(writeAPI api.WriteAPIBlocking, cfg RetryConfig, breaker *CircuitBreaker) *ResilientWriteAPI {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultMaxAttempts
+	}
+
+	if cfg.InitialDelay <= 0 {
+		cfg.InitialDelay = defaultInitialDelay
+	}
+
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = defaultMaxDelay
+	}
+
+	return &ResilientWriteAPI{
+		WriteAPIBlocking: writeAPI,
+		retry:            cfg,
+		breaker:          breaker,
+	}
+}
+
+func (w *ResilientWriteAPI) WritePoint(ctx context.Context, points ...*write.Point) error {
+	return w.do(ctx, func() error {
+		return w.WriteAPIBlocking.WritePoint(ctx, points...)
+	})
+}
+
+func (w *ResilientWriteAPI) WriteRecord(ctx context.Context, lines ...string) error {
+	return w.do(ctx, func() error {
+		return w.WriteAPIBlocking.WriteRecord(ctx, lines...)
+	})
+}
+
+func (w *ResilientWriteAPI) do(ctx context.Context, write func() error) error {
+	for attempt := 1; ; attempt++ {
+		if !w.breaker.Allow() {
+			return ErrCircuitOpen
+		}
+
+		err := write()
+		retryable, retryAfter := classifyWriteError(err)
+		if err == nil || !retryable {
+			// A rejected write still means InfluxDB is up and answering.
+			w.breaker.Success()
+			return err
+		}
+
+		w.breaker.Failure()
+		if attempt >= w.retry.MaxAttempts {
+			return err
+		}
+
+		delay := max(backoffDelay(w.retry.InitialDelay, w.retry.MaxDelay, attempt), retryAfter)
+		Log.Warn("Retrying influxdb write", "attempt", attempt, "delay", delay, "err", err)
+		writeRetries.WithLabelValues(w.breaker.name).Inc()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// IsRetryable reports whether a failed write may succeed later, as opposed to
+// being rejected by InfluxDB for good.
+func IsRetryable(err error) bool {
+	retryable, _ := classifyWriteError(err)
+	return retryable
+}
+
+// classifyWriteError treats 5xx, 429, network errors and an open circuit as
+// retryable, honouring Retry-After when InfluxDB sends one.
+func classifyWriteError(err error) (bool, time.Duration) {
+	if err == nil {
+		return false, 0
+	}
+
+	// Joined errors, e.g. from several sinks, are only worth retrying when
+	// every one of them is.
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var retryAfter time.Duration
+		for _, err := range joined.Unwrap() {
+			retryable, after := classifyWriteError(err)
+			if !retryable {
+				return false, 0
+			}
+			retryAfter = max(retryAfter, after)
+		}
+		return true, retryAfter
+	}
+
+	if errors.Is(err, ErrCircuitOpen) {
+		return true, 0
+	}
+
+	var httpErr *http2.Error
+	if errors.As(err, &httpErr) && httpErr.StatusCode != 0 {
+		retryAfter := time.Duration(httpErr.RetryAfter) * time.Second
+		switch {
+		case httpErr.StatusCode == http.StatusTooManyRequests:
+			return true, retryAfter
+		case httpErr.StatusCode >= http.StatusInternalServerError:
+			return true, retryAfter
+		default:
+			return false, 0
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return true, 0
+	}
+
+	return false, 0
+}
+
+// backoffDelay returns an exponential backoff for the given attempt with
+// jitter applied to the upper half, so it never drops below half the step.
+func backoffDelay(base time.Duration, max time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+
+	half := delay / 2
+	return half + rand.N(half+1)
+}
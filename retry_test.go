@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	http2 "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// flakyWriteAPI fails with the queued errors before succeeding.
+type flakyWriteAPI struct {
+	fakeWriteAPI
+	errs  []error
+	calls int
+}
+
+func (f *flakyWriteAPI) WritePoint(ctx context.Context, point ...*write.Point) error {
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return err
+	}
+
+	return f.fakeWriteAPI.WritePoint(ctx, point...)
+}
+
+func TestClassifyWriteError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		retryable  bool
+		retryAfter time.Duration
+	}{
+		{name: "nil", err: nil},
+		{name: "service unavailable", err: &http2.Error{StatusCode: http.StatusServiceUnavailable}, retryable: true},
+		{name: "too many requests", err: &http2.Error{StatusCode: http.StatusTooManyRequests, RetryAfter: 7}, retryable: true, retryAfter: 7 * time.Second},
+		{name: "bad request", err: &http2.Error{StatusCode: http.StatusBadRequest}},
+		{name: "unauthorized", err: &http2.Error{StatusCode: http.StatusUnauthorized}},
+		{name: "network error", err: http2.NewError(&net.OpError{Op: "dial", Err: errors.New("connection refused")}), retryable: true},
+		{name: "timeout", err: fmt.Errorf("write: %w", context.DeadlineExceeded), retryable: true},
+		{name: "circuit open", err: ErrCircuitOpen, retryable: true},
+		{name: "unknown", err: errors.New("cannot encode point")},
+		{name: "joined retryable", err: errors.Join(ErrCircuitOpen, &http2.Error{StatusCode: http.StatusTooManyRequests, RetryAfter: 3}), retryable: true, retryAfter: 3 * time.Second},
+		{name: "joined with permanent", err: errors.Join(ErrCircuitOpen, &http2.Error{StatusCode: http.StatusBadRequest})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retryable, retryAfter := classifyWriteError(tt.err)
+			if retryable != tt.retryable || retryAfter != tt.retryAfter {
+				t.Errorf("classifyWriteError() = (%v, %v), expected (%v, %v)", retryable, retryAfter, tt.retryable, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestResilientWriteAPI_RetriesTransientErrors(t *testing.T) {
+	inner := &flakyWriteAPI{errs: []error{
+		&http2.Error{StatusCode: http.StatusServiceUnavailable},
+		&http2.Error{StatusCode: http.StatusBadGateway},
+	}}
+	breaker := NewCircuitBreaker("retry-test", CircuitBreakerConfig{FailureThreshold: 10})
+	writeAPI := NewResilientWriteAPI(inner, RetryConfig{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}, breaker)
+	retries := testutil.ToFloat64(writeRetries.WithLabelValues("retry-test"))
+
+	if err := writeAPI.WritePoint(context.Background(), NewPoints(testMetrics(1))...); err != nil {
+		t.Fatalf("WritePoint() returned error: %v", err)
+	}
+	if inner.calls != 3 {
+		t.Errorf("expected 3 write attempts, got %d", inner.calls)
+	}
+	if got := testutil.ToFloat64(writeRetries.WithLabelValues("retry-test")) - retries; got != 2 {
+		t.Errorf("expected 2 retries recorded for the sink, got %v", got)
+	}
+	if breaker.State() != CircuitClosed {
+		t.Errorf("expected breaker to stay closed, got %v", breaker.State())
+	}
+}
+
+func TestResilientWriteAPI_DoesNotRetryPermanentErrors(t *testing.T) {
+	inner := &flakyWriteAPI{errs: []error{&http2.Error{StatusCode: http.StatusBadRequest}}}
+	writeAPI := NewResilientWriteAPI(inner, RetryConfig{MaxAttempts: 3, InitialDelay: time.Millisecond}, NewCircuitBreaker(SinkInflux, CircuitBreakerConfig{}))
+
+	if err := writeAPI.WritePoint(context.Background(), NewPoints(testMetrics(1))...); err == nil {
+		t.Fatal("expected WritePoint() to return the permanent error")
+	}
+	if inner.calls != 1 {
+		t.Errorf("expected a single write attempt, got %d", inner.calls)
+	}
+}
+
+func TestResilientWriteAPI_OpensBreaker(t *testing.T) {
+	unavailable := &http2.Error{StatusCode: http.StatusServiceUnavailable}
+	inner := &flakyWriteAPI{errs: []error{unavailable, unavailable, unavailable}}
+	breaker := NewCircuitBreaker(SinkInflux, CircuitBreakerConfig{FailureThreshold: 2, OpenTimeout: time.Hour})
+	writeAPI := NewResilientWriteAPI(inner, RetryConfig{MaxAttempts: 5, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}, breaker)
+
+	err := writeAPI.WritePoint(context.Background(), NewPoints(testMetrics(1))...)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	if inner.calls != 2 {
+		t.Errorf("expected writes to stop once the breaker opened, got %d calls", inner.calls)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for attempt := 1; attempt <= 10; attempt++ {
+		max := min(100*time.Millisecond<<(attempt-1), time.Second)
+		for i := 0; i < 50; i++ {
+			delay := backoffDelay(100*time.Millisecond, time.Second, attempt)
+			if delay < max/2 || delay > max {
+				t.Fatalf("attempt %d: delay %v outside [%v, %v]", attempt, delay, max/2, max)
+			}
+		}
+	}
+}
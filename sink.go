@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+const (
+	SinkInflux = "influx"
+	SinkFile   = "file"
+
+	PolicyRequired   = "required"
+	PolicyBestEffort = "best-effort"
+)
+
+// Sink is a destination the points of every batch are written to.
+type Sink interface {
+	Write(ctx context.Context, points []*write.Point) error
+	Flush(ctx context.Context) error
+	Close() error
+}
+
+// Throttler is implemented by sinks that want the pipeline to hold back new
+// messages while they cannot take any writes.
+type Throttler interface {
+	Wait(ctx context.Context) error
+}
+
+type namedSink struct {
+	name     string
+	sink     Sink
+	required bool
+}
+
+// MultiSink fans every write out to all of its sinks at once. The write only
+// fails when a required sink failed, so messages are acked as soon as every
+// required sink has their points; failures of best-effort sinks are logged
+// and dropped.
+type MultiSink struct {
+	sinks []namedSink
+}
+
+func NewMultiSink() *MultiSink {
+	return &MultiSink{}
+}
+
+func (m *MultiSink) Add(name string, sink Sink, required bool) {
+	m.sinks = append(m.sinks, namedSink{name: name, sink: sink, required: required})
+}
+
+func (m *MultiSink) Write(ctx context.Context, points []*write.Point) error {
+	errs := make([]error, len(m.sinks))
+
+	var wg sync.WaitGroup
+	for i, s := range m.sinks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			errs[i] = s.sink.Write(ctx, points)
+			sinkWriteDuration.WithLabelValues(s.name).Observe(time.Since(start).Seconds())
+		}()
+	}
+	wg.Wait()
+
+	var failed []error
+	for i, s := range m.sinks {
+		if errs[i] == nil {
+			pointsWritten.WithLabelValues(s.name).Add(float64(len(points)))
+			sinkLastWrite.WithLabelValues(s.name).SetToCurrentTime()
+			continue
+		}
+
+		sinkWriteErrors.WithLabelValues(s.name).Inc()
+		if !s.required {
+			Log.Warn("Cannot write to best-effort sink", "sink", s.name, "err", errs[i])
+			continue
+		}
+
+		failed = append(failed, fmt.Errorf("sink %s: %w", s.name, errs[i]))
+	}
+
+	return errors.Join(failed...)
+}
+
+func (m *MultiSink) Flush(ctx context.Context) error {
+	var errs []error
+	for _, s := range m.sinks {
+		if err := s.sink.Flush(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("sink %s: %w", s.name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Wait blocks while any required sink asks to hold back writes.
+func (m *MultiSink) Wait(ctx context.Context) error {
+	for _, s := range m.sinks {
+		throttler, ok := s.sink.(Throttler)
+		if !s.required || !ok {
+			continue
+		}
+
+		if err := throttler.Wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// HealthChecks collects the checks of every required sink, prefixed with the
+// name of the sink. Best-effort sinks never make carrot unready.
+func (m *MultiSink) HealthChecks() []HealthCheck {
+	var checks []HealthCheck
+	for _, s := range m.sinks {
+		reporter, ok := s.sink.(HealthReporter)
+		if !s.required || !ok {
+			continue
+		}
+
+		for _, check := range reporter.HealthChecks() {
+			if check.Name == "" {
+				check.Name = s.name
+			} else {
+				check.Name = s.name + "/" + check.Name
+			}
+			checks = append(checks, check)
+		}
+	}
+
+	return checks
+}
+
+func (m *MultiSink) Close() error {
+	var errs []error
+	for _, s := range m.sinks {
+		if err := s.sink.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("sink %s: %w", s.name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// OpenSinks opens every configured sink. Without a Sinks section the Influx
+// and Wal sections make up a single required InfluxDB sink.
+func OpenSinks(cfg *Config) (*MultiSink, error) {
+	sinks := cfg.Sinks
+	if len(sinks) == 0 {
+		sinks = []SinkConfig{{
+			Name:   SinkInflux,
+			Type:   SinkInflux,
+			Influx: cfg.InfluxdbConfig,
+			Wal:    cfg.Wal,
+		}}
+	}
+
+	multi := NewMultiSink()
+	for i, sinkCfg := range sinks {
+		name := sinkCfg.Name
+		if name == "" {
+			name = fmt.Sprintf("sinks[%d]", i)
+		}
+
+		required, err := sinkRequired(sinkCfg.Policy)
+		if err != nil {
+			multi.Close()
+			return nil, fmt.Errorf("sink %s: %v", name, err)
+		}
+
+		sinkCfg.Name = name
+		sink, err := OpenSink(sinkCfg)
+		if err != nil {
+			multi.Close()
+			return nil, fmt.Errorf("sink %s: %v", name, err)
+		}
+
+		Log.Info("Writing metrics to sink", "sink", name, "type", sinkCfg.Type, "required", required)
+		multi.Add(name, sink, required)
+	}
+
+	return multi, nil
+}
+
+func OpenSink(cfg SinkConfig) (Sink, error) {
+	switch cfg.Type {
+	case "", SinkInflux:
+		return OpenInfluxSink(cfg.Name, cfg.Influx, cfg.Wal)
+	case SinkFile:
+		return OpenFileSink(cfg.File)
+	default:
+		return nil, fmt.Errorf("unsupported sink type: %s", cfg.Type)
+	}
+}
+
+func sinkRequired(policy string) (bool, error) {
+	switch policy {
+	case "", PolicyRequired:
+		return true, nil
+	case PolicyBestEffort:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unsupported sink policy: %s", policy)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	http2 "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+type fakeSink struct {
+	mu      sync.Mutex
+	points  []*write.Point
+	err     error
+	waited  int
+	flushed int
+	closed  bool
+}
+
+func (f *fakeSink) Write(ctx context.Context, points []*write.Point) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+
+	f.points = append(f.points, points...)
+	return nil
+}
+
+func (f *fakeSink) Flush(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.flushed++
+	return nil
+}
+
+func (f *fakeSink) Wait(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.waited++
+	return nil
+}
+
+func (f *fakeSink) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	return nil
+}
+
+func TestMultiSink_WritesToAllSinks(t *testing.T) {
+	first, second := &fakeSink{}, &fakeSink{}
+	sink := NewMultiSink()
+	sink.Add("first", first, true)
+	sink.Add("second", second, true)
+
+	if err := sink.Write(context.Background(), NewPoints(testMetrics(2))); err != nil {
+		t.Fatalf("Write() unexpected error: %v", err)
+	}
+
+	if len(first.points) != 2 || len(second.points) != 2 {
+		t.Errorf("expected both sinks to get 2 points, got %d and %d", len(first.points), len(second.points))
+	}
+}
+
+func TestMultiSink_BestEffortFailuresAreDropped(t *testing.T) {
+	required := &fakeSink{}
+	sink := NewMultiSink()
+	sink.Add("required", required, true)
+	sink.Add("optional", &fakeSink{err: errors.New("disk full")}, false)
+
+	if err := sink.Write(context.Background(), NewPoints(testMetrics(1))); err != nil {
+		t.Fatalf("Write() expected best-effort failure to be ignored, got %v", err)
+	}
+	if len(required.points) != 1 {
+		t.Errorf("expected required sink to get the point, got %d", len(required.points))
+	}
+}
+
+func TestMultiSink_RequiredFailures(t *testing.T) {
+	unavailable := &http2.Error{StatusCode: http.StatusServiceUnavailable}
+	rejected := &http2.Error{StatusCode: http.StatusBadRequest}
+
+	tests := []struct {
+		name      string
+		errs      []error
+		retryable bool
+	}{
+		{name: "one unavailable", errs: []error{nil, unavailable}, retryable: true},
+		{name: "all unavailable", errs: []error{unavailable, unavailable}, retryable: true},
+		{name: "one rejected", errs: []error{unavailable, rejected}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := NewMultiSink()
+			for i, err := range tt.errs {
+				sink.Add([]string{"eu", "us"}[i], &fakeSink{err: err}, true)
+			}
+
+			err := sink.Write(context.Background(), NewPoints(testMetrics(1)))
+			if err == nil {
+				t.Fatal("Write() expected error, got nil")
+			}
+			if IsRetryable(err) != tt.retryable {
+				t.Errorf("IsRetryable(%v) = %v, expected %v", err, !tt.retryable, tt.retryable)
+			}
+		})
+	}
+}
+
+func TestMultiSink_WaitsOnRequiredSinks(t *testing.T) {
+	required, optional := &fakeSink{}, &fakeSink{}
+	sink := NewMultiSink()
+	sink.Add("required", required, true)
+	sink.Add("optional", optional, false)
+
+	if err := sink.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait() unexpected error: %v", err)
+	}
+	if required.waited != 1 || optional.waited != 0 {
+		t.Errorf("expected only the required sink to be waited on, got %d and %d", required.waited, optional.waited)
+	}
+
+	sink.Flush(context.Background())
+	sink.Close()
+	if required.flushed != 1 || optional.flushed != 1 || !required.closed || !optional.closed {
+		t.Error("expected every sink to be flushed and closed")
+	}
+}
+
+func TestOpenSinks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.lp")
+	cfg := &Config{Sinks: []SinkConfig{
+		{Name: "audit", Type: SinkFile, Policy: PolicyBestEffort, File: FileSinkConfig{Path: path}},
+	}}
+
+	sink, err := OpenSinks(cfg)
+	if err != nil {
+		t.Fatalf("OpenSinks() unexpected error: %v", err)
+	}
+	defer sink.Close()
+
+	if len(sink.sinks) != 1 || sink.sinks[0].name != "audit" || sink.sinks[0].required {
+		t.Errorf("expected a single best-effort sink named audit, got %+v", sink.sinks)
+	}
+
+	invalid := []SinkConfig{
+		{Type: "kafka"},
+		{Type: SinkFile, Policy: "sometimes", File: FileSinkConfig{Path: path}},
+		{Type: SinkFile},
+	}
+	for _, sinkCfg := range invalid {
+		if _, err := OpenSinks(&Config{Sinks: []SinkConfig{sinkCfg}}); err == nil {
+			t.Errorf("OpenSinks(%+v) expected error, got nil", sinkCfg)
+		}
+	}
+}
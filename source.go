@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	SourceRabbit = "rabbit"
+	SourceKafka  = "kafka"
+	SourceMqtt   = "mqtt"
+	SourceNats   = "nats"
+	SourceApi    = "api"
+)
+
+// Message is a single body received from a Source together with the
+// callbacks that settle it.
+type Message struct {
+	Body            []byte
+	ContentType     string
+	ContentEncoding string
+	Headers         map[string]any
+	MessageID       string
+	CorrelationID   string
+
+	// Timestamp is when the message was published, if the source knows.
+	Timestamp time.Time
+
+	// Tags are derived from where the message came from, like its MQTT
+	// topic. Tags in the envelope take precedence over them.
+	Tags map[string]string
+
+	// Raw is the source specific message, e.g. an amqp.Delivery.
+	Raw any
+
+	// Ack confirms the message has been written.
+	Ack func() error
+	// Nack hands a failed message back to its source. With retry set the
+	// source redelivers it later, otherwise it is dead-lettered or dropped.
+	Nack func(stage string, reason error, retry bool) error
+
+	logID string
+}
+
+type Source interface {
+	Messages() <-chan *Message
+	// Cancel stops receiving. Messages already received are still handed
+	// out before the Messages channel is closed.
+	Cancel() error
+	Close() error
+}
+
+// BatchAcker is implemented by sources that can settle many messages at once
+// more cheaply than acking them one by one.
+type BatchAcker interface {
+	AckBatch(msgs []*Message) error
+}
+
+// ackMessages acks msgs through source's BatchAcker when it has one.
+func ackMessages(source Source, msgs []*Message) {
+	acker, ok := source.(BatchAcker)
+	if !ok {
+		ackEach(msgs)
+		return
+	}
+
+	if err := acker.AckBatch(msgs); err != nil {
+		Log.Error("Cannot ack messages", "err", err)
+	}
+}
+
+// messageQueue hands messages from callback driven clients like MQTT and NATS
+// to the pipeline, and refuses them once it was closed.
+type messageQueue struct {
+	messages  chan *Message
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// mu guards sends on messages against it being closed.
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newMessageQueue() *messageQueue {
+	return &messageQueue{
+		messages: make(chan *Message),
+		done:     make(chan struct{}),
+	}
+}
+
+// deliver hands msg to the pipeline unless the queue was closed, in which
+// case the caller keeps it unsettled.
+func (q *messageQueue) deliver(msg *Message) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return false
+	}
+
+	select {
+	case q.messages <- msg:
+		return true
+	case <-q.done:
+		return false
+	}
+}
+
+func (q *messageQueue) close() {
+	q.closeOnce.Do(func() {
+		close(q.done)
+
+		q.mu.Lock()
+		q.closed = true
+		close(q.messages)
+		q.mu.Unlock()
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "carrot"
+
+var (
+	messagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_received_total",
+		Help:      "Messages received from a source.",
+	}, []string{"source"})
+
+	messagesParsed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_parsed_total",
+		Help:      "Messages decoded into metrics.",
+	}, []string{"source"})
+
+	messagesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_failed_total",
+		Help:      "Messages handed back to their source, by the stage they failed at.",
+	}, []string{"source", "stage"})
+
+	messageLag = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "message_lag_seconds",
+		Help:      "Time between a message being published and carrot receiving it.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 12),
+	}, []string{"source"})
+
+	sourceReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "source_reconnects_total",
+		Help:      "Times a source reconnected to its broker after losing the connection.",
+	}, []string{"source"})
+
+	batchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "batch_size_points",
+		Help:      "Points per batch written to the sinks.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	})
+
+	pointsWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "points_written_total",
+		Help:      "Points written to a sink.",
+	}, []string{"sink"})
+
+	sinkWriteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "sink_write_duration_seconds",
+		Help:      "Latency of writes to a sink, including failed ones.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"sink"})
+
+	sinkWriteErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sink_write_failures_total",
+		Help:      "Failed writes to a sink.",
+	}, []string{"sink"})
+
+	sinkLastWrite = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "sink_last_write_timestamp_seconds",
+		Help:      "Unix time of the last successful write to a sink, for alerting on stalls.",
+	}, []string{"sink"})
+
+	writeRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "write_retries_total",
+		Help:      "Writes to an InfluxDB sink retried after a retryable error.",
+	}, []string{"sink"})
+
+	circuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_state",
+		Help:      "State of the circuit breaker of an InfluxDB sink: 0 closed, 1 open, 2 half-open.",
+	}, []string{"sink"})
+
+	circuitTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_transitions_total",
+		Help:      "Circuit breaker transitions of an InfluxDB sink, by the state entered.",
+	}, []string{"sink", "state"})
+
+	walSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "wal_size_bytes",
+		Help:      "Bytes of points waiting in a write-ahead log to be replayed.",
+	}, []string{"dir"})
+)
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPipeline_RecordsMessageMetrics(t *testing.T) {
+	validator, err := NewValidator(ValidationConfig{Strict: true})
+	if err != nil {
+		t.Fatalf("NewValidator() unexpected error: %v", err)
+	}
+
+	source := NewMemorySource(0)
+	pipeline := &Pipeline{
+		Name:      "telemetry-test",
+		Source:    source,
+		Sink:      NewInfluxSink(&fakeWriteAPI{}),
+		Validator: validator,
+	}
+
+	// The collectors are global, so compare against their values before the
+	// run to keep the test repeatable with -count.
+	received := testutil.ToFloat64(messagesReceived.WithLabelValues("telemetry-test"))
+	parsed := testutil.ToFloat64(messagesParsed.WithLabelValues("telemetry-test"))
+	parseFailures := testutil.ToFloat64(messagesFailed.WithLabelValues("telemetry-test", StageParse))
+	validateFailures := testutil.ToFloat64(messagesFailed.WithLabelValues("telemetry-test", StageValidate))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- pipeline.RunContext(ctx)
+	}()
+
+	source.PublishMessage(&Message{Body: []byte(metricBody("cpu")), Timestamp: time.Now().Add(-time.Second)})
+	source.Publish([]byte(`{invalid json`))
+	source.Publish([]byte(`{"metrics": []}`))
+	cancel()
+
+	if err := <-result; err != nil {
+		t.Fatalf("RunContext() returned error: %v", err)
+	}
+
+	if got := testutil.ToFloat64(messagesReceived.WithLabelValues("telemetry-test")) - received; got != 3 {
+		t.Errorf("expected 3 received messages, got %v", got)
+	}
+	if got := testutil.ToFloat64(messagesParsed.WithLabelValues("telemetry-test")) - parsed; got != 2 {
+		t.Errorf("expected 2 parsed messages, got %v", got)
+	}
+	if got := testutil.ToFloat64(messagesFailed.WithLabelValues("telemetry-test", StageParse)) - parseFailures; got != 1 {
+		t.Errorf("expected 1 parse failure, got %v", got)
+	}
+	if got := testutil.ToFloat64(messagesFailed.WithLabelValues("telemetry-test", StageValidate)) - validateFailures; got != 1 {
+		t.Errorf("expected 1 validation failure, got %v", got)
+	}
+	if got := testutil.CollectAndCount(messageLag, "carrot_message_lag_seconds"); got == 0 {
+		t.Error("expected message lag to be observed")
+	}
+}
+
+func TestMultiSink_RecordsWriteMetrics(t *testing.T) {
+	multi := NewMultiSink()
+	multi.Add("telemetry-ok", &fakeSink{}, true)
+	multi.Add("telemetry-down", &fakeSink{err: errors.New("down")}, false)
+
+	written := testutil.ToFloat64(pointsWritten.WithLabelValues("telemetry-ok"))
+	writeErrors := testutil.ToFloat64(sinkWriteErrors.WithLabelValues("telemetry-down"))
+
+	points := []*write.Point{write.NewPoint("cpu", nil, map[string]any{"value": 1.0}, time.Now())}
+	if err := multi.Write(context.Background(), points); err != nil {
+		t.Fatalf("Write() unexpected error: %v", err)
+	}
+
+	if got := testutil.ToFloat64(pointsWritten.WithLabelValues("telemetry-ok")) - written; got != 1 {
+		t.Errorf("expected 1 point written, got %v", got)
+	}
+	if got := testutil.ToFloat64(sinkWriteErrors.WithLabelValues("telemetry-down")) - writeErrors; got != 1 {
+		t.Errorf("expected 1 write failure, got %v", got)
+	}
+	if got := testutil.ToFloat64(sinkLastWrite.WithLabelValues("telemetry-ok")); got < float64(time.Now().Add(-time.Minute).Unix()) {
+		t.Errorf("expected last write timestamp to be recent, got %v", got)
+	}
+	if got := testutil.ToFloat64(sinkLastWrite.WithLabelValues("telemetry-down")); got != 0 {
+		t.Errorf("expected no last write for failing sink, got %v", got)
+	}
+}
+
+func TestWAL_RecordsSize(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(WalConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("OpenWAL() unexpected error: %v", err)
+	}
+	defer wal.Close()
+
+	points := []*write.Point{write.NewPoint("cpu", nil, map[string]any{"value": 1.0}, time.Now())}
+	if err := wal.Append(points); err != nil {
+		t.Fatalf("Append() unexpected error: %v", err)
+	}
+
+	if got := testutil.ToFloat64(walSize.WithLabelValues(dir)); got != float64(wal.Size()) {
+		t.Errorf("expected wal size gauge %d, got %v", wal.Size(), got)
+	}
+}
+
+func TestAdminServer_Metrics(t *testing.T) {
+	messagesReceived.WithLabelValues("admin-test").Inc()
+
+	server := NewAdminServer(AdminConfig{Host: "127.0.0.1", Port: 9100}, nil)
+	if server.Addr != "127.0.0.1:9100" {
+		t.Errorf("expected addr 127.0.0.1:9100, got %s", server.Addr)
+	}
+
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	if !strings.Contains(string(body), `carrot_messages_received_total{source="admin-test"} `) {
+		t.Errorf("expected carrot metrics in response, got:\n%s", body)
+	}
+}
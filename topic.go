@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TopicTemplate maps the levels of a topic or subject into tags, e.g.
+// "sensors/{site}/{device}" turns "sensors/tlv/t-1000" into site=tlv and
+// device=t-1000. Levels can also be the single-level wildcard to skip them,
+// and the template may end in the multi-level wildcard to ignore the rest.
+type TopicTemplate struct {
+	separator string
+	levels    []topicLevel
+	rest      bool
+}
+
+type topicLevel struct {
+	tag     string
+	literal string
+	any     bool
+}
+
+// ParseTopicTemplate parses template using the separator and wildcards of a
+// protocol, "/", "+" and "#" for MQTT or ".", "*" and ">" for NATS. An empty
+// template yields nil, which maps no tags.
+func ParseTopicTemplate(template string, separator string, single string, multi string) (*TopicTemplate, error) {
+	if template == "" {
+		return nil, nil
+	}
+
+	t := &TopicTemplate{separator: separator}
+	parts := strings.Split(template, separator)
+	for i, part := range parts {
+		switch {
+		case part == multi:
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("invalid topic template %q: %s must be the last level", template, multi)
+			}
+			t.rest = true
+		case part == single:
+			t.levels = append(t.levels, topicLevel{any: true})
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			tag := part[1 : len(part)-1]
+			if tag == "" {
+				return nil, fmt.Errorf("invalid topic template %q: empty tag name", template)
+			}
+			t.levels = append(t.levels, topicLevel{tag: tag})
+		case strings.ContainsAny(part, "{}"):
+			return nil, fmt.Errorf("invalid topic template %q: tags must span a whole level", template)
+		default:
+			t.levels = append(t.levels, topicLevel{literal: part})
+		}
+	}
+
+	return t, nil
+}
+
+// Tags returns the tags captured from topic, or nil if it does not match the
+// template.
+func (t *TopicTemplate) Tags(topic string) map[string]string {
+	if t == nil {
+		return nil
+	}
+
+	parts := strings.Split(topic, t.separator)
+	if len(parts) < len(t.levels) || (!t.rest && len(parts) != len(t.levels)) {
+		return nil
+	}
+
+	tags := make(map[string]string)
+	for i, level := range t.levels {
+		switch {
+		case level.any:
+		case level.tag != "":
+			tags[level.tag] = parts[i]
+		case level.literal != parts[i]:
+			return nil
+		}
+	}
+
+	return tags
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTopicTemplate_Tags(t *testing.T) {
+	tests := []struct {
+		template  string
+		separator string
+		single    string
+		multi     string
+		topic     string
+		expected  map[string]string
+	}{
+		{template: "sensors/{site}/{device}", separator: "/", single: "+", multi: "#", topic: "sensors/tlv/t-1000", expected: map[string]string{"site": "tlv", "device": "t-1000"}},
+		{template: "sensors/{site}/+/{device}", separator: "/", single: "+", multi: "#", topic: "sensors/tlv/floor-2/t-1000", expected: map[string]string{"site": "tlv", "device": "t-1000"}},
+		{template: "sensors/{site}/#", separator: "/", single: "+", multi: "#", topic: "sensors/tlv/a/b", expected: map[string]string{"site": "tlv"}},
+		{template: "sensors/{site}/{device}", separator: "/", single: "+", multi: "#", topic: "sensors/tlv"},
+		{template: "sensors/{site}/{device}", separator: "/", single: "+", multi: "#", topic: "actuators/tlv/t-1000"},
+		{template: "metrics.{service}.>", separator: ".", single: "*", multi: ">", topic: "metrics.billing.eu.cpu", expected: map[string]string{"service": "billing"}},
+	}
+
+	for _, tt := range tests {
+		template, err := ParseTopicTemplate(tt.template, tt.separator, tt.single, tt.multi)
+		if err != nil {
+			t.Fatalf("ParseTopicTemplate(%q) unexpected error: %v", tt.template, err)
+		}
+
+		if tags := template.Tags(tt.topic); !reflect.DeepEqual(tags, tt.expected) {
+			t.Errorf("%q.Tags(%q) = %v, expected %v", tt.template, tt.topic, tags, tt.expected)
+		}
+	}
+}
+
+func TestParseTopicTemplate_Invalid(t *testing.T) {
+	for _, template := range []string{"sensors/#/{device}", "sensors/{}/x", "sensors/site-{site}"} {
+		if _, err := ParseTopicTemplate(template, "/", "+", "#"); err == nil {
+			t.Errorf("ParseTopicTemplate(%q) expected error, got nil", template)
+		}
+	}
+
+	template, err := ParseTopicTemplate("", "/", "+", "#")
+	if err != nil || template.Tags("a/b") != nil {
+		t.Errorf("expected empty template to map no tags, got %v, %v", template, err)
+	}
+}
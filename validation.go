@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const StageValidate = "validate"
+
+var valueTypes = []string{"number", "string", "bool"}
+
+type ValidationIssue struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects every problem found in an envelope rather than
+// stopping at the first one.
+type ValidationError struct {
+	Issues []ValidationIssue
+}
+
+func (e *ValidationError) Error() string {
+	issues := make([]string, len(e.Issues))
+	for i, issue := range e.Issues {
+		issues[i] = issue.Path + ": " + issue.Message
+	}
+
+	return fmt.Sprintf("%d validation errors: %s", len(e.Issues), strings.Join(issues, "; "))
+}
+
+func (e *ValidationError) add(path string, format string, args ...any) {
+	e.Issues = append(e.Issues, ValidationIssue{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+type Validator struct {
+	cfg          ValidationConfig
+	namePattern  *regexp.Regexp
+	allowedTypes []string
+}
+
+// NewValidator returns nil unless strict validation is enabled; a nil
+// Validator only rejects empty batches.
+func NewValidator(cfg ValidationConfig) (*Validator, error) {
+	if !cfg.Strict {
+		return nil, nil
+	}
+
+	v := &Validator{cfg: cfg, allowedTypes: cfg.AllowedTypes}
+	if len(v.allowedTypes) == 0 {
+		v.allowedTypes = valueTypes
+	}
+
+	for _, kind := range v.allowedTypes {
+		if !slices.Contains(valueTypes, kind) {
+			return nil, fmt.Errorf("unsupported value type %q, expected one of %v", kind, valueTypes)
+		}
+	}
+
+	if cfg.NamePattern != "" {
+		pattern, err := regexp.Compile(cfg.NamePattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name pattern: %v", err)
+		}
+		v.namePattern = pattern
+	}
+
+	return v, nil
+}
+
+func (v *Validator) Validate(metrics []*Metric) error {
+	result := &ValidationError{}
+
+	// Checked in every mode, so an empty batch is never acked as written.
+	if len(metrics) == 0 {
+		result.add("metrics", "must contain at least one metric")
+		return result
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	for i, metric := range metrics {
+		path := fmt.Sprintf("metrics[%d]", i)
+		v.validateName(result, path+".name", metric.Name)
+
+		if len(metric.Fields) > 0 {
+			for _, key := range slices.Sorted(maps.Keys(metric.Fields)) {
+				if key == "" {
+					result.add(path+".fields", "field key must not be empty")
+				}
+				v.validateValue(result, fmt.Sprintf("%s.fields.%s", path, key), metric.Fields[key])
+			}
+		} else {
+			v.validateValue(result, path+".value", metric.Value)
+		}
+
+		v.validateTags(result, path+".tags", metric.Tags)
+	}
+
+	if len(result.Issues) > 0 {
+		return result
+	}
+
+	return nil
+}
+
+func (v *Validator) validateName(result *ValidationError, path string, name string) {
+	if name == "" {
+		result.add(path, "must not be empty")
+		return
+	}
+
+	if v.namePattern != nil && !v.namePattern.MatchString(name) {
+		result.add(path, "%q does not match %s", name, v.namePattern)
+	}
+}
+
+func (v *Validator) validateValue(result *ValidationError, path string, value any) {
+	kind := valueType(value)
+	if !slices.Contains(v.allowedTypes, kind) {
+		result.add(path, "%s value is not allowed, expected one of %v", kind, v.allowedTypes)
+	}
+}
+
+func (v *Validator) validateTags(result *ValidationError, path string, tags map[string]string) {
+	if v.cfg.MaxTags > 0 && len(tags) > v.cfg.MaxTags {
+		result.add(path, "has %d tags, at most %d allowed", len(tags), v.cfg.MaxTags)
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(tags)) {
+		value := tags[key]
+		if v.cfg.MaxTagKeyLength > 0 && len(key) > v.cfg.MaxTagKeyLength {
+			result.add(path, "key %.32q is longer than %d bytes", key, v.cfg.MaxTagKeyLength)
+		}
+
+		if v.cfg.MaxTagValueLength > 0 && len(value) > v.cfg.MaxTagValueLength {
+			result.add(path+"."+key, "value is longer than %d bytes", v.cfg.MaxTagValueLength)
+		}
+	}
+}
+
+func valueType(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case float64, float32, int, int64, int32, uint64, uint32:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewValidator(t *testing.T) {
+	validator, err := NewValidator(ValidationConfig{})
+	if err != nil || validator != nil {
+		t.Fatalf("expected nil validator without strict mode, got %v, %v", validator, err)
+	}
+	if err := validator.Validate([]*Metric{{Value: "anything"}}); err != nil {
+		t.Errorf("expected nil validator to accept any metric, got %v", err)
+	}
+	if err := validator.Validate(nil); err == nil {
+		t.Error("expected nil validator to reject an empty batch")
+	}
+
+	if _, err := NewValidator(ValidationConfig{Strict: true, NamePattern: "("}); err == nil {
+		t.Error("expected error for invalid name pattern")
+	}
+	if _, err := NewValidator(ValidationConfig{Strict: true, AllowedTypes: []string{"number", "object"}}); err == nil {
+		t.Error("expected error for unsupported value type")
+	}
+}
+
+func TestValidator_Validate(t *testing.T) {
+	ts := time.Date(2023, 10, 15, 14, 30, 45, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		cfg      ValidationConfig
+		metrics  []*Metric
+		expected []ValidationIssue
+	}{
+		{
+			name: "valid metrics",
+			cfg:  ValidationConfig{Strict: true, NamePattern: `^[a-z_]+$`, MaxTags: 2},
+			metrics: []*Metric{
+				{Name: "cpu_usage", Value: 75.5, Timestamp: ts, Tags: map[string]string{"host": "server1"}},
+				{Name: "cpu", Fields: map[string]any{"user": 1.0, "state": "ok", "throttled": false}, Timestamp: ts},
+			},
+		},
+		{
+			name:     "empty metrics array",
+			cfg:      ValidationConfig{Strict: true},
+			metrics:  []*Metric{},
+			expected: []ValidationIssue{{Path: "metrics", Message: "must contain at least one metric"}},
+		},
+		{
+			name: "name and value problems",
+			cfg:  ValidationConfig{Strict: true, NamePattern: `^[a-z_]+$`},
+			metrics: []*Metric{
+				{Name: "CPU Usage", Value: 1.0},
+				{Name: "", Value: map[string]any{"nested": true}},
+				{Name: "cpu", Fields: map[string]any{"cores": []any{1.0, 2.0}, "user": nil}},
+			},
+			expected: []ValidationIssue{
+				{Path: "metrics[0].name", Message: `"CPU Usage" does not match ^[a-z_]+$`},
+				{Path: "metrics[1].name", Message: "must not be empty"},
+				{Path: "metrics[1].value", Message: "object value is not allowed, expected one of [number string bool]"},
+				{Path: "metrics[2].fields.cores", Message: "array value is not allowed, expected one of [number string bool]"},
+				{Path: "metrics[2].fields.user", Message: "null value is not allowed, expected one of [number string bool]"},
+			},
+		},
+		{
+			name: "restricted value types",
+			cfg:  ValidationConfig{Strict: true, AllowedTypes: []string{"number"}},
+			metrics: []*Metric{
+				{Name: "status", Value: "healthy"},
+			},
+			expected: []ValidationIssue{
+				{Path: "metrics[0].value", Message: "string value is not allowed, expected one of [number]"},
+			},
+		},
+		{
+			name: "tag bounds",
+			cfg:  ValidationConfig{Strict: true, MaxTags: 1, MaxTagKeyLength: 4, MaxTagValueLength: 5},
+			metrics: []*Metric{
+				{Name: "cpu", Value: 1.0, Tags: map[string]string{"host": "server1", "region": "eu"}},
+			},
+			expected: []ValidationIssue{
+				{Path: "metrics[0].tags", Message: "has 2 tags, at most 1 allowed"},
+				{Path: "metrics[0].tags.host", Message: "value is longer than 5 bytes"},
+				{Path: "metrics[0].tags", Message: `key "region" is longer than 4 bytes`},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator, err := NewValidator(tt.cfg)
+			if err != nil {
+				t.Fatalf("NewValidator() unexpected error: %v", err)
+			}
+
+			err = validator.Validate(tt.metrics)
+			if tt.expected == nil {
+				if err != nil {
+					t.Errorf("Validate() unexpected error: %v", err)
+				}
+				return
+			}
+
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("expected *ValidationError, got %v", err)
+			}
+			if !reflect.DeepEqual(validationErr.Issues, tt.expected) {
+				t.Errorf("Validate() issues = %+v, expected %+v", validationErr.Issues, tt.expected)
+			}
+		})
+	}
+}
+
+func TestValidationError_Error(t *testing.T) {
+	err := &ValidationError{Issues: []ValidationIssue{
+		{Path: "metrics[0].name", Message: "must not be empty"},
+		{Path: "metrics[1].value", Message: "null value is not allowed"},
+	}}
+
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "2 validation errors") ||
+		!strings.Contains(msg, "metrics[0].name: must not be empty") ||
+		!strings.Contains(msg, "metrics[1].value: null value is not allowed") {
+		t.Errorf("unexpected error message: %s", msg)
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+const (
+	defaultSegmentSize    = 64 << 20
+	defaultWalMaxSize     = 1 << 30
+	defaultReplayInterval = 10 * time.Second
+
+	walExt          = ".wal"
+	walOffsetFile   = "replay.offset"
+	walHeaderSize   = 8
+	walMaxRecordLen = 256 << 20
+)
+
+var ErrWalFull = errors.New("wal is full")
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WAL is an append-only log of line protocol records split into numbered
+// segment files. Each record is framed by its length and a CRC-32C checksum
+// and fsynced before Append returns.
+type WAL struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+
+	mu         sync.Mutex
+	active     *os.File
+	activeSeq  uint64
+	activeSize int64
+	size       int64
+	// rejected is set once a record did not fit and cleared by replay.
+	rejected bool
+
+	// replayed is how far segment replayedSeq has been replayed already.
+	// It is kept in walOffsetFile too, so a restart does not write the
+	// replayed records again.
+	replayedSeq uint64
+	replayed    int64
+}
+
+func OpenWAL(cfg WalConfig) (*WAL, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	w := &WAL{
+		dir:         cfg.Dir,
+		segmentSize: cfg.SegmentSize,
+		maxSize:     cfg.MaxSize,
+	}
+
+	if w.segmentSize <= 0 {
+		w.segmentSize = defaultSegmentSize
+	}
+
+	if w.maxSize <= 0 {
+		w.maxSize = defaultWalMaxSize
+	}
+
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, seq := range segments {
+		info, err := os.Stat(w.segmentPath(seq))
+		if err != nil {
+			return nil, err
+		}
+		w.size += info.Size()
+		w.activeSeq = seq
+	}
+
+	if w.replayedSeq, w.replayed, err = w.readOffset(); err != nil {
+		return nil, err
+	}
+
+	if err := w.openSegment(w.activeSeq + 1); err != nil {
+		return nil, err
+	}
+	walSize.WithLabelValues(w.dir).Set(float64(w.size))
+
+	return w, nil
+}
+
+// Append durably stores the line protocol of points as one record.
+func (w *WAL) Append(points []*write.Point) error {
+	payload, err := encodePoints(points)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, walTable))
+	copy(record[walHeaderSize:], payload)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.size+int64(len(record)) > w.maxSize {
+		w.rejected = true
+		return ErrWalFull
+	}
+
+	if w.activeSize > 0 && w.activeSize+int64(len(record)) > w.segmentSize {
+		if err := w.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.active.Write(record); err != nil {
+		return err
+	}
+
+	if err := w.active.Sync(); err != nil {
+		return err
+	}
+
+	w.activeSize += int64(len(record))
+	w.size += int64(len(record))
+	walSize.WithLabelValues(w.dir).Set(float64(w.size))
+
+	return nil
+}
+
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.size
+}
+
+// Full reports whether the WAL has no room left for new records, in which
+// case writes have to wait for InfluxDB again. A record that did not fit
+// keeps it full until a segment was replayed.
+func (w *WAL) Full() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.rejected || w.size >= w.maxSize
+}
+
+// Replay writes every stored record to writeAPI, oldest first, deleting each
+// segment once all its records were accepted. It stops at the first failed
+// write and picks up from that record on the next call, also after a restart.
+func (w *WAL) Replay(ctx context.Context, writeAPI api.WriteAPIBlocking) error {
+	w.mu.Lock()
+	if w.activeSize > 0 {
+		if err := w.rotateLocked(); err != nil {
+			w.mu.Unlock()
+			return err
+		}
+	}
+	active := w.activeSeq
+	w.mu.Unlock()
+
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, seq := range segments {
+		if seq >= active {
+			break
+		}
+
+		if err := w.replaySegment(ctx, seq, writeAPI); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *WAL) replaySegment(ctx context.Context, seq uint64, writeAPI api.WriteAPIBlocking) error {
+	path := w.segmentPath(seq)
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var offset int64
+	w.mu.Lock()
+	if w.replayedSeq == seq {
+		offset = w.replayed
+	}
+	w.mu.Unlock()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		payload, n, err := readWalRecord(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if errors.Is(err, errWalChecksum) {
+			Log.Error("Skipping corrupt wal record", "segment", path, "offset", offset)
+			offset += n
+			if err := w.setReplayed(seq, offset); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err != nil {
+			// A torn or unreadable tail cannot be resynchronised, so the
+			// rest of the segment is dropped.
+			Log.Error("Cannot read wal segment, dropping its remainder", "segment", path, "offset", offset, "err", err)
+			break
+		}
+
+		if err := writeAPI.WriteRecord(ctx, strings.TrimSuffix(string(payload), "\n")); err != nil {
+			if IsRetryable(err) {
+				return err
+			}
+
+			// InfluxDB rejects the record for good, e.g. a field type
+			// conflict, so it is dropped rather than blocking the records
+			// behind it.
+			Log.Error("Dropping wal record rejected by influxdb", "segment", path, "offset", offset, "err", err)
+		}
+
+		offset += n
+		if err := w.setReplayed(seq, offset); err != nil {
+			return err
+		}
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	// The saved offset names the removed segment, so it is ignored even if
+	// the directory is not synced before a crash.
+	if err := syncDir(w.dir); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.size -= info.Size()
+	w.rejected = false
+	walSize.WithLabelValues(w.dir).Set(float64(w.size))
+	w.mu.Unlock()
+
+	Log.Info("Replayed wal segment", "segment", path)
+	return nil
+}
+
+// setReplayed durably records that segment seq was replayed up to offset.
+func (w *WAL) setReplayed(seq uint64, offset int64) error {
+	tmp := filepath.Join(w.dir, walOffsetFile+".tmp")
+	if err := writeFileSync(tmp, fmt.Appendf(nil, "%d %d\n", seq, offset)); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(w.dir, walOffsetFile)); err != nil {
+		return err
+	}
+
+	if err := syncDir(w.dir); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.replayedSeq, w.replayed = seq, offset
+	return nil
+}
+
+// readOffset returns the replay offset saved by setReplayed, if any.
+func (w *WAL) readOffset() (uint64, int64, error) {
+	data, err := os.ReadFile(filepath.Join(w.dir, walOffsetFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var seq uint64
+	var offset int64
+	if _, err := fmt.Sscan(string(data), &seq, &offset); err != nil {
+		// Replaying a segment from its start only repeats writes.
+		Log.Error("Ignoring unreadable wal replay offset", "dir", w.dir, "err", err)
+		return 0, 0, nil
+	}
+
+	return seq, offset, nil
+}
+
+// RunReplayer replays the WAL every interval until ctx is done.
+func (w *WAL) RunReplayer(ctx context.Context, writeAPI api.WriteAPIBlocking, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultReplayInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if w.Size() == 0 {
+			continue
+		}
+
+		if err := w.Replay(ctx, writeAPI); err != nil {
+			Log.Warn("Cannot replay wal yet", "bytes", w.Size(), "err", err)
+		}
+	}
+}
+
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.active.Close()
+}
+
+var errWalChecksum = errors.New("wal record checksum mismatch")
+
+// readWalRecord returns the next record's payload and the number of bytes it
+// took up in the segment.
+func readWalRecord(r io.Reader) ([]byte, int64, error) {
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, 0, fmt.Errorf("truncated wal record header: %w", err)
+		}
+		return nil, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > walMaxRecordLen {
+		return nil, 0, fmt.Errorf("wal record length %d exceeds limit", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, fmt.Errorf("truncated wal record: %w", err)
+	}
+
+	n := int64(walHeaderSize + length)
+	if crc32.Checksum(payload, walTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, n, errWalChecksum
+	}
+
+	return payload, n, nil
+}
+
+func (w *WAL) rotateLocked() error {
+	if err := w.active.Close(); err != nil {
+		return err
+	}
+
+	return w.openSegment(w.activeSeq + 1)
+}
+
+func (w *WAL) openSegment(seq uint64) error {
+	file, err := os.OpenFile(w.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+
+	// Without syncing the directory a crash could lose the new segment
+	// along with the records fsynced into it.
+	if err := syncDir(w.dir); err != nil {
+		file.Close()
+		return err
+	}
+
+	w.active = file
+	w.activeSeq = seq
+	w.activeSize = 0
+
+	return nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+func (w *WAL) segmentPath(seq uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", seq, walExt))
+}
+
+func (w *WAL) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, walExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, walExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, seq)
+	}
+
+	slices.Sort(segments)
+	return segments, nil
+}
+
+// SpillingWriteAPI stores points in the WAL when InfluxDB cannot take them
+// right now, so the write still counts as done.
+type SpillingWriteAPI struct {
+	api.WriteAPIBlocking
+	wal *WAL
+}
+
+func NewSpillingWriteAPI(writeAPI api.WriteAPIBlocking, wal *WAL) *SpillingWriteAPI {
+	return &SpillingWriteAPI{WriteAPIBlocking: writeAPI, wal: wal}
+}
+
+func (w *SpillingWriteAPI) WritePoint(ctx context.Context, points ...*write.Point) error {
+	err := w.WriteAPIBlocking.WritePoint(ctx, points...)
+	if err == nil || !IsRetryable(err) {
+		return err
+	}
+
+	if walErr := w.wal.Append(points); walErr != nil {
+		// Keep the write error as the cause so it is still retried.
+		return fmt.Errorf("%w, cannot spill to wal: %v", err, walErr)
+	}
+
+	Log.Warn("Spilled metrics to wal", "points", len(points), "err", err)
+	return nil
+}
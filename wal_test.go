@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	http2 "github.com/influxdata/influxdb-client-go/v2/api/http"
+)
+
+func walPoints(names ...string) []*Metric {
+	metrics := make([]*Metric, len(names))
+	for i, name := range names {
+		metrics[i] = &Metric{
+			Name:      name,
+			Value:     float64(i),
+			Timestamp: time.Unix(1697380245, 0),
+			Tags:      map[string]string{"host": "server1"},
+		}
+	}
+	return metrics
+}
+
+func TestWAL_AppendAndReplay(t *testing.T) {
+	wal, err := OpenWAL(WalConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("OpenWAL() returned error: %v", err)
+	}
+	defer wal.Close()
+
+	if err := wal.Append(NewPoints(walPoints("cpu", "mem"))); err != nil {
+		t.Fatalf("Append() returned error: %v", err)
+	}
+	if err := wal.Append(NewPoints(walPoints("disk"))); err != nil {
+		t.Fatalf("Append() returned error: %v", err)
+	}
+	if wal.Size() == 0 {
+		t.Fatal("expected wal to hold data after Append()")
+	}
+
+	writeAPI := &fakeWriteAPI{}
+	if err := wal.Replay(context.Background(), writeAPI); err != nil {
+		t.Fatalf("Replay() returned error: %v", err)
+	}
+
+	expected := []string{
+		"cpu,host=server1 cpu=0 1697380245000000000\nmem,host=server1 mem=1 1697380245000000000",
+		"disk,host=server1 disk=0 1697380245000000000",
+	}
+	records := writeAPI.Records()
+	if len(records) != len(expected) {
+		t.Fatalf("expected %d replayed records, got %d: %q", len(expected), len(records), records)
+	}
+	for i := range expected {
+		if records[i] != expected[i] {
+			t.Errorf("record %d = %q, expected %q", i, records[i], expected[i])
+		}
+	}
+	if wal.Size() != 0 {
+		t.Errorf("expected empty wal after replay, got %d bytes", wal.Size())
+	}
+}
+
+func TestWAL_ReplayResumesAfterFailure(t *testing.T) {
+	wal, err := OpenWAL(WalConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("OpenWAL() returned error: %v", err)
+	}
+	defer wal.Close()
+
+	wal.Append(NewPoints(walPoints("cpu")))
+
+	writeAPI := &fakeWriteAPI{err: &http2.Error{StatusCode: http.StatusServiceUnavailable}}
+	if err := wal.Replay(context.Background(), writeAPI); err == nil {
+		t.Fatal("expected Replay() to return the write error")
+	}
+	if wal.Size() == 0 {
+		t.Fatal("expected failed replay to keep the data")
+	}
+
+	wal.Append(NewPoints(walPoints("mem")))
+
+	writeAPI.SetErr(nil)
+	if err := wal.Replay(context.Background(), writeAPI); err != nil {
+		t.Fatalf("Replay() returned error: %v", err)
+	}
+
+	records := writeAPI.Records()
+	if len(records) != 2 || !strings.HasPrefix(records[0], "cpu,") || !strings.HasPrefix(records[1], "mem,") {
+		t.Errorf("expected records replayed in order, got %q", records)
+	}
+}
+
+func TestWAL_ReplaySkipsRejectedRecords(t *testing.T) {
+	wal, err := OpenWAL(WalConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("OpenWAL() returned error: %v", err)
+	}
+	defer wal.Close()
+
+	wal.Append(NewPoints(walPoints("cpu")))
+	wal.Append(NewPoints(walPoints("mem")))
+
+	writeAPI := &rejectingWriteAPI{reject: "cpu,"}
+	if err := wal.Replay(context.Background(), writeAPI); err != nil {
+		t.Fatalf("Replay() returned error: %v", err)
+	}
+
+	records := writeAPI.Records()
+	if len(records) != 1 || !strings.HasPrefix(records[0], "mem,") {
+		t.Errorf("expected only the record behind the rejected one to be written, got %q", records)
+	}
+	if wal.Size() != 0 {
+		t.Errorf("expected wal to be emptied, got %d bytes", wal.Size())
+	}
+}
+
+// rejectingWriteAPI fails records with the given prefix the way InfluxDB
+// does for a field type conflict.
+func TestWAL_ReplayOffsetSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(WalConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("OpenWAL() returned error: %v", err)
+	}
+
+	wal.Append(NewPoints(walPoints("cpu")))
+	wal.Append(NewPoints(walPoints("mem")))
+
+	unavailable := &rejectingWriteAPI{reject: "mem,", err: &http2.Error{StatusCode: http.StatusServiceUnavailable}}
+	if err := wal.Replay(context.Background(), unavailable); err == nil {
+		t.Fatal("expected Replay() to return the write error")
+	}
+	wal.Close()
+
+	wal, err = OpenWAL(WalConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("OpenWAL() returned error: %v", err)
+	}
+	defer wal.Close()
+
+	writeAPI := &fakeWriteAPI{}
+	if err := wal.Replay(context.Background(), writeAPI); err != nil {
+		t.Fatalf("Replay() returned error: %v", err)
+	}
+
+	records := writeAPI.Records()
+	if len(records) != 1 || !strings.HasPrefix(records[0], "mem,") {
+		t.Errorf("expected only the record not replayed before the restart, got %q", records)
+	}
+}
+
+// rejectingWriteAPI fails writes of records starting with reject, with err or
+// a permanent 422 by default.
+type rejectingWriteAPI struct {
+	fakeWriteAPI
+	reject string
+	err    error
+}
+
+func (r *rejectingWriteAPI) WriteRecord(ctx context.Context, line ...string) error {
+	if strings.HasPrefix(strings.Join(line, "\n"), r.reject) {
+		if r.err != nil {
+			return r.err
+		}
+		return &http2.Error{StatusCode: http.StatusUnprocessableEntity, Message: "field type conflict"}
+	}
+
+	return r.fakeWriteAPI.WriteRecord(ctx, line...)
+}
+
+func TestWAL_RotatesSegments(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(WalConfig{Dir: dir, SegmentSize: 64})
+	if err != nil {
+		t.Fatalf("OpenWAL() returned error: %v", err)
+	}
+	defer wal.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := wal.Append(NewPoints(walPoints("cpu"))); err != nil {
+			t.Fatalf("Append() returned error: %v", err)
+		}
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+walExt))
+	if len(segments) != 3 {
+		t.Errorf("expected 3 segments, got %d", len(segments))
+	}
+}
+
+func TestWAL_Full(t *testing.T) {
+	wal, err := OpenWAL(WalConfig{Dir: t.TempDir(), MaxSize: 100})
+	if err != nil {
+		t.Fatalf("OpenWAL() returned error: %v", err)
+	}
+	defer wal.Close()
+
+	if err := wal.Append(NewPoints(walPoints("cpu"))); err != nil {
+		t.Fatalf("Append() returned error: %v", err)
+	}
+
+	if wal.Full() {
+		t.Error("expected wal with room left not to be full")
+	}
+
+	err = wal.Append(NewPoints(walPoints("cpu", "mem", "disk")))
+	if !errors.Is(err, ErrWalFull) {
+		t.Fatalf("expected ErrWalFull, got %v", err)
+	}
+	if !wal.Full() {
+		t.Error("expected wal to be full after rejecting a record")
+	}
+}
+
+func TestWAL_ReopenKeepsSegments(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(WalConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("OpenWAL() returned error: %v", err)
+	}
+	wal.Append(NewPoints(walPoints("cpu")))
+	size := wal.Size()
+	wal.Close()
+
+	reopened, err := OpenWAL(WalConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("OpenWAL() returned error: %v", err)
+	}
+	defer reopened.Close()
+
+	if reopened.Size() != size {
+		t.Errorf("expected reopened wal to hold %d bytes, got %d", size, reopened.Size())
+	}
+
+	writeAPI := &fakeWriteAPI{}
+	if err := reopened.Replay(context.Background(), writeAPI); err != nil {
+		t.Fatalf("Replay() returned error: %v", err)
+	}
+	if len(writeAPI.Records()) != 1 {
+		t.Errorf("expected 1 record replayed after reopening, got %d", len(writeAPI.Records()))
+	}
+}
+
+func TestWAL_SkipsCorruptRecords(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(WalConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("OpenWAL() returned error: %v", err)
+	}
+	wal.Append(NewPoints(walPoints("cpu")))
+	wal.Append(NewPoints(walPoints("mem")))
+	wal.Close()
+
+	segment := filepath.Join(dir, "00000000000000000001"+walExt)
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatalf("Failed to read segment: %v", err)
+	}
+
+	// Flip a payload byte of the first record and tear the second one.
+	data[walHeaderSize] ^= 0xff
+	data = data[:len(data)-3]
+	if err := os.WriteFile(segment, data, 0o640); err != nil {
+		t.Fatalf("Failed to write segment: %v", err)
+	}
+
+	reopened, err := OpenWAL(WalConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("OpenWAL() returned error: %v", err)
+	}
+	defer reopened.Close()
+
+	writeAPI := &fakeWriteAPI{}
+	if err := reopened.Replay(context.Background(), writeAPI); err != nil {
+		t.Fatalf("Replay() returned error: %v", err)
+	}
+	if len(writeAPI.Records()) != 0 {
+		t.Errorf("expected corrupt and torn records to be skipped, got %q", writeAPI.Records())
+	}
+	if reopened.Size() != 0 {
+		t.Errorf("expected damaged segment to be removed, got %d bytes left", reopened.Size())
+	}
+}
+
+func TestSpillingWriteAPI(t *testing.T) {
+	wal, err := OpenWAL(WalConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("OpenWAL() returned error: %v", err)
+	}
+	defer wal.Close()
+
+	inner := &fakeWriteAPI{err: &http2.Error{StatusCode: http.StatusServiceUnavailable}}
+	writeAPI := NewSpillingWriteAPI(inner, wal)
+
+	if err := writeAPI.WritePoint(context.Background(), NewPoints(walPoints("cpu"))...); err != nil {
+		t.Fatalf("expected retryable failure to be spilled, got %v", err)
+	}
+	if wal.Size() == 0 {
+		t.Fatal("expected spilled points in the wal")
+	}
+
+	inner.SetErr(&http2.Error{StatusCode: http.StatusBadRequest})
+	if err := writeAPI.WritePoint(context.Background(), NewPoints(walPoints("cpu"))...); err == nil {
+		t.Fatal("expected permanent failure to be returned instead of spilled")
+	}
+}